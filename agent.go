@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// SSH agent forwarding (ssh -A): a per-session unix socket whose
+// connections are passed back to the client's agent.
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// May this connection forward the client's agent?
+func (conn *ServerConn) permitsAgentForwarding() bool {
+	return !conn.NoAgentForwarding && !conn.opts.NoAgentForwarding
+}
+
+// Handle auth-agent-req@openssh.com: listen on a socket in a private
+// directory, which the session's command finds through SSH_AUTH_SOCK.
+func (conn *ServerConn) startAgentForwarding(sess *session) error {
+	if sess.agent != nil {
+		return nil
+	}
+	// TempDir creates the directory readable only by us.
+	dir, err := ioutil.TempDir("", "sshdog-agent")
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := chownToAccount(conn.account, dir, l.Addr().String()); err != nil {
+		l.Close()
+		os.RemoveAll(dir)
+		return err
+	}
+	dbg.Debug("Agent forwarding on %s", l.Addr())
+	sess.agent = l
+	sess.agentDir = dir
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				dbg.Debug("Agent listener done: %v", err)
+				return
+			}
+			go func() {
+				defer c.Close()
+				conn.forwardToClient("auth-agent@openssh.com", nil, c)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Stop agent forwarding and remove the socket and its directory
+func (sess *session) closeAgent() {
+	if sess.agent == nil {
+		return
+	}
+	sess.agent.Close()
+	if err := os.RemoveAll(sess.agentDir); err != nil {
+		dbg.Debug("Unable to remove %s: %v", sess.agentDir, err)
+	}
+	sess.agent = nil
+}
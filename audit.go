@@ -0,0 +1,164 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Audit log: one JSON object per line for each connection, authentication
+// attempt, session, scp or sftp transfer, sftp file change and forwarded
+// connection.  Every event has "time", "event" and "conn", a connection ID
+// shared by all events of one connection.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event fields besides time, event and conn
+type auditFields map[string]interface{}
+
+type auditLog struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// Write audit events to path, or to stdout if path is "-"
+func (s *Server) SetAuditLog(path string) error {
+	if path == "-" {
+		s.auditLog = &auditLog{w: os.Stdout}
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.auditLog = &auditLog{w: f}
+	return nil
+}
+
+// Emit an event, if auditing is on
+func (s *Server) audit(connID, event string, fields auditFields) {
+	if s.auditLog == nil {
+		return
+	}
+	record := auditFields{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"event": event,
+		"conn":  connID,
+	}
+	for k, v := range fields {
+		record[k] = v
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		dbg.Debug("Error encoding audit event: %v", err)
+		return
+	}
+	s.auditLog.Lock()
+	defer s.auditLog.Unlock()
+	if _, err := s.auditLog.w.Write(append(line, '\n')); err != nil {
+		dbg.Debug("Error writing audit event: %v", err)
+	}
+}
+
+func (conn *ServerConn) audit(event string, fields auditFields) {
+	conn.Server.audit(conn.id, event, fields)
+}
+
+// Emit an event for a file operation, with its outcome
+func (conn *ServerConn) auditResult(event string, fields auditFields, err error) {
+	fields["success"] = err == nil
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	conn.audit(event, fields)
+}
+
+// Record an authentication attempt
+func (s *Server) auditAuthAttempt(conn ssh.ConnMetadata, method string, err error) {
+	id, fingerprint := s.handshakes.lookup(conn.RemoteAddr().String())
+	fields := auditFields{
+		"method":  method,
+		"user":    conn.User(),
+		"success": err == nil,
+	}
+	if method == "publickey" && fingerprint != "" {
+		fields["key_fingerprint"] = fingerprint
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	s.audit(id, "auth", fields)
+}
+
+// Random ID for a new connection
+func newConnID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// What we know about a connection before it authenticates
+type handshake struct {
+	id string
+	// Key last offered, since AuthLogCallback isn't told
+	keyFingerprint string
+}
+
+// Connections still in the handshake, by remote address, so that the
+// authentication callbacks can find their IDs.
+type handshakeSet struct {
+	sync.Mutex
+	conns map[string]*handshake
+}
+
+func (set *handshakeSet) add(addr, id string) {
+	set.Lock()
+	defer set.Unlock()
+	if set.conns == nil {
+		set.conns = make(map[string]*handshake)
+	}
+	set.conns[addr] = &handshake{id: id}
+}
+
+func (set *handshakeSet) remove(addr string) {
+	set.Lock()
+	defer set.Unlock()
+	delete(set.conns, addr)
+}
+
+// Remember the key being tried on a connection
+func (set *handshakeSet) offerKey(addr, fingerprint string) {
+	set.Lock()
+	defer set.Unlock()
+	if hs, ok := set.conns[addr]; ok {
+		hs.keyFingerprint = fingerprint
+	}
+}
+
+// ID and last offered key of a connection
+func (set *handshakeSet) lookup(addr string) (string, string) {
+	set.Lock()
+	defer set.Unlock()
+	if hs, ok := set.conns[addr]; ok {
+		return hs.id, hs.keyFingerprint
+	}
+	return "", ""
+}
@@ -0,0 +1,382 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// authorized_keys options, as described in the AUTHORIZED_KEYS FILE FORMAT
+// section of sshd(8).
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restrictions attached to an authorized key.  The zero value places no
+// restrictions on the connection.
+type keyOptions struct {
+	Command           string
+	From              []string
+	NoPty             bool
+	NoPortForwarding  bool
+	NoAgentForwarding bool
+	NoX11Forwarding   bool
+	PermitOpen        []string
+	PermitListen      []string
+	Environment       []string
+	ExpiryTime        time.Time
+	Record            *bool    // nil leaves it to the user and server
+	Principals        []string // cert-authority only: names certificates must carry
+}
+
+// Names used to carry keyOptions through ssh.Permissions
+const (
+	permForceCommand      = "force-command"
+	permNoPty             = "no-pty"
+	permNoPortForwarding  = "no-port-forwarding"
+	permNoAgentForwarding = "no-agent-forwarding"
+	permNoX11Forwarding   = "no-X11-forwarding"
+	permPermitOpen        = "permitopen"
+	permPermitListen      = "permitlisten"
+	permEnvironment       = "environment"
+	permRecord            = "record"
+)
+
+// Parse authorized_keys data into keys with their options, plus any
+// cert-authority keys with theirs.  Keys with options we can't honor are
+// skipped.
+func parseAuthorizedKeys(keyData []byte) (map[string]*keyOptions, map[string]*keyOptions) {
+	keys := make(map[string]*keyOptions)
+	caKeys := make(map[string]*keyOptions)
+	for len(keyData) > 0 {
+		newKey, _, options, left, err := ssh.ParseAuthorizedKey(keyData)
+		keyData = left
+		if err != nil {
+			dbg.Debug("Error parsing key: %v", err)
+			break
+		}
+		opts, err := parseKeyOptions(options)
+		if err != nil {
+			dbg.Debug("Skipping key with bad options: %v", err)
+			continue
+		}
+		if hasCertAuthorityOption(options) {
+			caKeys[string(newKey.Marshal())] = opts
+			continue
+		}
+		if len(opts.Principals) > 0 {
+			dbg.Debug("Skipping key with principals= but no cert-authority.")
+			continue
+		}
+		keys[string(newKey.Marshal())] = opts
+	}
+	return keys, caKeys
+}
+
+// Split an option into its name and (unquoted) value
+func splitKeyOption(opt string) (string, string, error) {
+	eq := strings.IndexByte(opt, '=')
+	if eq < 0 {
+		return strings.ToLower(opt), "", nil
+	}
+	name, value := strings.ToLower(opt[:eq]), opt[eq+1:]
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", "", fmt.Errorf("option %s: value must be quoted", name)
+	}
+	value = value[1 : len(value)-1]
+	value = strings.Replace(value, "\\\"", "\"", -1)
+	return name, value, nil
+}
+
+// Parse an expiry-time value: YYYYMMDD[HHMM[SS]], in local time unless
+// suffixed with Z.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		loc = time.UTC
+		value = value[:len(value)-1]
+	}
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+	return time.ParseInLocation(layout, value, loc)
+}
+
+// Parse the options returned by ssh.ParseAuthorizedKey
+func parseKeyOptions(options []string) (*keyOptions, error) {
+	opts := &keyOptions{}
+	for _, opt := range options {
+		name, value, err := splitKeyOption(opt)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "command":
+			opts.Command = value
+		case "from":
+			opts.From = strings.Split(value, ",")
+		case "no-pty":
+			opts.NoPty = true
+		case "pty":
+			opts.NoPty = false
+		case "no-port-forwarding":
+			opts.NoPortForwarding = true
+		case "port-forwarding":
+			opts.NoPortForwarding = false
+		case "no-agent-forwarding":
+			opts.NoAgentForwarding = true
+		case "agent-forwarding":
+			opts.NoAgentForwarding = false
+		case "no-x11-forwarding":
+			opts.NoX11Forwarding = true
+		case "x11-forwarding":
+			opts.NoX11Forwarding = false
+		case "restrict":
+			opts.NoPty = true
+			opts.NoPortForwarding = true
+			opts.NoAgentForwarding = true
+			opts.NoX11Forwarding = true
+		case "permitopen":
+			if _, _, err := splitPermitHostPort(value); err != nil {
+				return nil, err
+			}
+			opts.PermitOpen = append(opts.PermitOpen, value)
+		case "permitlisten":
+			if !strings.Contains(value, ":") {
+				value = ":" + value
+			}
+			if _, _, err := splitPermitHostPort(value); err != nil {
+				return nil, err
+			}
+			opts.PermitListen = append(opts.PermitListen, value)
+		case "environment":
+			if strings.IndexByte(value, '=') <= 0 {
+				return nil, fmt.Errorf("invalid environment %q", value)
+			}
+			opts.Environment = append(opts.Environment, value)
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			opts.ExpiryTime = t
+		case "record", "no-record":
+			// Our own: turn session recording on or off for this key.
+			record := name == "record"
+			opts.Record = &record
+		case "principals":
+			opts.Principals = strings.Split(value, ",")
+		case "cert-authority":
+			// Handled by parseAuthorizedKeys
+		case "no-user-rc", "user-rc":
+			// Nothing to do: we never run rc files.
+		default:
+			return nil, fmt.Errorf("unsupported option %q", name)
+		}
+	}
+	return opts, nil
+}
+
+// Split a permitopen/permitlisten value into host and port, where the
+// port may be "*".
+func splitPermitHostPort(value string) (string, string, error) {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return "", "", err
+	}
+	if port != "*" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("invalid port in %q", value)
+		}
+	}
+	return host, port, nil
+}
+
+// Does the key line carry the cert-authority marker?
+func hasCertAuthorityOption(options []string) bool {
+	for _, opt := range options {
+		if strings.EqualFold(opt, "cert-authority") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the key may be used right now from the given address
+func (opts *keyOptions) checkLogin(remote net.Addr, now time.Time) error {
+	if !opts.ExpiryTime.IsZero() && now.After(opts.ExpiryTime) {
+		return fmt.Errorf("key expired at %v", opts.ExpiryTime)
+	}
+	if len(opts.From) > 0 {
+		host, _, err := net.SplitHostPort(remote.String())
+		if err != nil {
+			host = remote.String()
+		}
+		if !matchFromPatterns(opts.From, host) {
+			return fmt.Errorf("connection from %s not permitted by from=", host)
+		}
+	}
+	return nil
+}
+
+// Match an address against a from= pattern list.  Any negated match
+// denies; otherwise at least one pattern must match.
+func matchFromPatterns(patterns []string, host string) bool {
+	ip := net.ParseIP(host)
+	matched := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var ok bool
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+			ok = ip != nil && ipNet.Contains(ip)
+		} else {
+			ok = wildcardMatch(strings.ToLower(pattern), strings.ToLower(host))
+		}
+		if ok && negate {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// Match a string against a pattern where '*' matches any run of characters
+// and '?' matches exactly one.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// Does a permitopen/permitlisten list allow host:port?  An empty list
+// allows everything.  A pattern without a host matches any host.
+func permitsHostPort(permits []string, host string, port uint32) bool {
+	if len(permits) == 0 {
+		return true
+	}
+	for _, permit := range permits {
+		pHost, pPort, err := splitPermitHostPort(permit)
+		if err != nil {
+			continue
+		}
+		if pHost != "" && pHost != "*" && !strings.EqualFold(pHost, host) {
+			continue
+		}
+		if pPort == "*" || pPort == strconv.Itoa(int(port)) {
+			return true
+		}
+	}
+	return false
+}
+
+// May the client open a direct-tcpip channel to host:port?
+func (opts *keyOptions) permitsOpen(host string, port uint32) bool {
+	return !opts.NoPortForwarding && permitsHostPort(opts.PermitOpen, host, port)
+}
+
+// May the client ask us to listen on addr:port?
+func (opts *keyOptions) permitsListen(addr string, port uint32) bool {
+	return !opts.NoPortForwarding && permitsHostPort(opts.PermitListen, addr, port)
+}
+
+func setPermission(m map[string]string, name string, set bool) {
+	if set {
+		m[name] = ""
+	}
+}
+
+func joinPermission(m map[string]string, name string, values []string) {
+	if len(values) > 0 {
+		m[name] = strings.Join(values, "\n")
+	}
+}
+
+func splitPermission(m map[string]string, name string) []string {
+	if value, ok := m[name]; ok {
+		return strings.Split(value, "\n")
+	}
+	return nil
+}
+
+// Encode the options so they survive the handshake in ssh.Permissions
+func (opts *keyOptions) permissions() *ssh.Permissions {
+	perms := &ssh.Permissions{
+		CriticalOptions: make(map[string]string),
+		Extensions:      make(map[string]string),
+	}
+	if opts.Command != "" {
+		perms.CriticalOptions[permForceCommand] = opts.Command
+	}
+	setPermission(perms.Extensions, permNoPty, opts.NoPty)
+	setPermission(perms.Extensions, permNoPortForwarding, opts.NoPortForwarding)
+	setPermission(perms.Extensions, permNoAgentForwarding, opts.NoAgentForwarding)
+	setPermission(perms.Extensions, permNoX11Forwarding, opts.NoX11Forwarding)
+	joinPermission(perms.Extensions, permPermitOpen, opts.PermitOpen)
+	joinPermission(perms.Extensions, permPermitListen, opts.PermitListen)
+	joinPermission(perms.Extensions, permEnvironment, opts.Environment)
+	if opts.Record != nil {
+		perms.Extensions[permRecord] = strconv.FormatBool(*opts.Record)
+	}
+	return perms
+}
+
+// Recover the options from an authenticated connection's permissions
+func keyOptionsFromPermissions(perms *ssh.Permissions) *keyOptions {
+	opts := &keyOptions{}
+	if perms == nil {
+		return opts
+	}
+	opts.Command = perms.CriticalOptions[permForceCommand]
+	_, opts.NoPty = perms.Extensions[permNoPty]
+	_, opts.NoPortForwarding = perms.Extensions[permNoPortForwarding]
+	_, opts.NoAgentForwarding = perms.Extensions[permNoAgentForwarding]
+	_, opts.NoX11Forwarding = perms.Extensions[permNoX11Forwarding]
+	opts.PermitOpen = splitPermission(perms.Extensions, permPermitOpen)
+	opts.PermitListen = splitPermission(perms.Extensions, permPermitListen)
+	opts.Environment = splitPermission(perms.Extensions, permEnvironment)
+	if value, ok := perms.Extensions[permRecord]; ok {
+		record := value == "true"
+		opts.Record = &record
+	}
+	return opts
+}
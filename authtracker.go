@@ -0,0 +1,162 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Brute-force protection: track authentication failures per remote IP and
+// temporarily ban addresses that fail too often.
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBanThreshold = 10
+	defaultBanWindow    = 10 * time.Minute
+	defaultBanDuration  = 30 * time.Minute
+)
+
+// Failures recorded for one address
+type authFailureRecord struct {
+	failures    []time.Time
+	bannedUntil time.Time
+}
+
+type authTracker struct {
+	sync.Mutex
+	// Failures within Window that trigger a ban; 0 disables banning.
+	Threshold int
+	Window    time.Duration
+	Duration  time.Duration
+	records   map[string]*authFailureRecord
+	pruned    time.Time // last sweep for stale records
+}
+
+func newAuthTracker() *authTracker {
+	return &authTracker{
+		Threshold: defaultBanThreshold,
+		Window:    defaultBanWindow,
+		Duration:  defaultBanDuration,
+		records:   make(map[string]*authFailureRecord),
+	}
+}
+
+// IP part of a remote address
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Is the address currently banned?
+func (t *authTracker) banned(ip string) bool {
+	t.Lock()
+	defer t.Unlock()
+	rec, ok := t.records[ip]
+	return ok && time.Now().Before(rec.bannedUntil)
+}
+
+// Record a failed attempt, banning the address if it crossed the threshold
+func (t *authTracker) fail(ip string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.Threshold <= 0 {
+		return
+	}
+	now := time.Now()
+	t.prune(now)
+	rec, ok := t.records[ip]
+	if !ok {
+		rec = &authFailureRecord{}
+		t.records[ip] = rec
+	}
+	if now.Before(rec.bannedUntil) {
+		return
+	}
+	cutoff := now.Add(-t.Window)
+	recent := rec.failures[:0]
+	for _, when := range rec.failures {
+		if when.After(cutoff) {
+			recent = append(recent, when)
+		}
+	}
+	rec.failures = append(recent, now)
+	if len(rec.failures) < t.Threshold {
+		return
+	}
+	dbg.Warn("Banning %s for %v after %d authentication failures.", ip, t.Duration, len(rec.failures))
+	rec.failures = nil
+	rec.bannedUntil = now.Add(t.Duration)
+	time.AfterFunc(t.Duration, func() { t.unban(ip, rec) })
+}
+
+// Forget addresses that aren't banned and haven't failed within Window,
+// at most once per Window, so scanners can't grow the map forever.  Called
+// with the lock held.
+func (t *authTracker) prune(now time.Time) {
+	if now.Sub(t.pruned) < t.Window {
+		return
+	}
+	t.pruned = now
+	cutoff := now.Add(-t.Window)
+	for ip, rec := range t.records {
+		if now.Before(rec.bannedUntil) {
+			continue
+		}
+		if n := len(rec.failures); n == 0 || !rec.failures[n-1].After(cutoff) {
+			delete(t.records, ip)
+		}
+	}
+}
+
+func (t *authTracker) unban(ip string, rec *authFailureRecord) {
+	t.Lock()
+	defer t.Unlock()
+	if t.records[ip] != rec || time.Now().Before(rec.bannedUntil) {
+		return
+	}
+	dbg.Info("Unbanning %s.", ip)
+	delete(t.records, ip)
+}
+
+// Forget failures after a successful login
+func (t *authTracker) succeed(ip string) {
+	t.Lock()
+	defer t.Unlock()
+	if rec, ok := t.records[ip]; ok && !time.Now().Before(rec.bannedUntil) {
+		delete(t.records, ip)
+	}
+}
+
+// Called by the ssh package for every authentication attempt
+func (s *Server) logAuthAttempt(conn ssh.ConnMetadata, method string, err error) {
+	ip := addrIP(conn.RemoteAddr())
+	if method != "none" || err == nil {
+		s.auditAuthAttempt(conn, method, err)
+	}
+	if err == nil {
+		s.authFailures.succeed(ip)
+		return
+	}
+	// Clients always probe with "none" first; that isn't a guess.
+	if method == "none" {
+		return
+	}
+	dbg.Debug("Failed %s authentication for %s from %s", method, conn.User(), ip)
+	s.authFailures.fail(ip)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthTrackerBansAtThreshold(t *testing.T) {
+	tracker := newAuthTracker()
+	tracker.Threshold = 3
+	for i := 0; i < tracker.Threshold-1; i++ {
+		tracker.fail("192.0.2.1")
+	}
+	if tracker.banned("192.0.2.1") {
+		t.Fatal("banned below the threshold")
+	}
+	tracker.fail("192.0.2.1")
+	if !tracker.banned("192.0.2.1") {
+		t.Fatal("not banned at the threshold")
+	}
+	if tracker.banned("192.0.2.2") {
+		t.Error("ban spilled over to another address")
+	}
+}
+
+func TestAuthTrackerCountsOnlyWithinWindow(t *testing.T) {
+	tracker := newAuthTracker()
+	tracker.Threshold = 3
+	tracker.Window = 50 * time.Millisecond
+	tracker.fail("192.0.2.1")
+	tracker.fail("192.0.2.1")
+	time.Sleep(2 * tracker.Window)
+	tracker.fail("192.0.2.1")
+	if tracker.banned("192.0.2.1") {
+		t.Error("failures outside the window counted towards a ban")
+	}
+}
+
+func TestAuthTrackerLiftsBanAfterDuration(t *testing.T) {
+	tracker := newAuthTracker()
+	tracker.Threshold = 1
+	tracker.Duration = 50 * time.Millisecond
+	tracker.fail("192.0.2.1")
+	if !tracker.banned("192.0.2.1") {
+		t.Fatal("not banned")
+	}
+	time.Sleep(2 * tracker.Duration)
+	if tracker.banned("192.0.2.1") {
+		t.Error("still banned after the duration")
+	}
+	tracker.Lock()
+	defer tracker.Unlock()
+	if _, ok := tracker.records["192.0.2.1"]; ok {
+		t.Error("record kept after the ban was lifted")
+	}
+}
+
+func TestBannedAddressDroppedBeforeHandshake(t *testing.T) {
+	server := NewServer()
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	server.Socket = sock
+	server.authFailures.Threshold = 1
+	server.authFailures.fail("127.0.0.1")
+	accepted := server.acceptChannel()
+
+	conn, err := net.Dial("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Dropped at once: not even the version banner is sent.
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("banned connection read %d bytes, %v; want EOF", n, err)
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Error("banned connection handed on")
+	default:
+	}
+
+	server.authFailures.succeed("127.0.0.1") // banned: must not lift it
+	server.authFailures.Lock()
+	server.authFailures.records["127.0.0.1"].bannedUntil = time.Now()
+	server.authFailures.Unlock()
+	conn2, err := net.Dial("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Error("connection not accepted once the ban was over")
+	}
+}
+
+func TestAuthTrackerPrunesStaleRecords(t *testing.T) {
+	tracker := newAuthTracker()
+	tracker.Window = 50 * time.Millisecond
+	tracker.fail("192.0.2.1")
+	tracker.fail("192.0.2.2")
+	time.Sleep(2 * tracker.Window)
+	tracker.fail("192.0.2.3")
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	if len(tracker.records) != 1 || tracker.records["192.0.2.3"] == nil {
+		t.Errorf("records after window = %v, want only 192.0.2.3", tracker.records)
+	}
+}
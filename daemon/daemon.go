@@ -2,5 +2,8 @@
 
 package daemon
 
+// Where the daemon's output goes, where that's up to us
+var LogPath = "sshdog.log"
+
 // Start and return a wait and stop function
 type DaemonWorker func() (func(), func())
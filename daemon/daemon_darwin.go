@@ -26,7 +26,7 @@ import (
 	"syscall"
 )
 
-var dbg = dbglog.Dbg
+var dbg = dbglog.Dbg.Subsystem("daemon")
 
 // Attempts to restart this process in the background.
 // This is not a *true* daemonize, as the process is
@@ -38,19 +38,13 @@ func Daemonize(f DaemonWorker) error {
 	proc.SysProcAttr = &syscall.SysProcAttr{}
 	proc.SysProcAttr.Setpgid = true
 	proc.SysProcAttr.Pgid = 0
-	output, err := os.OpenFile("sshdog.log", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
-		dbg.Fatalf("failed to open log file: %v", err)
-		return err
-	}
-	dbg.Debug("opened daemon log file: %v", output.Fd())
 	//if userInfo, err := user.Current(); err == nil {
 	//	proc.Dir = userInfo.HomeDir
 	//}
-	proc.Stdout = output
-	proc.Stderr = output
-	//proc.Stdout = os.Stdout
-	//proc.Stdout = os.Stderr
+	// No stdio: the worker opens LogPath itself and rotates it, and a
+	// handle of ours would keep writing to the old file after a rotation.
+	proc.Stdout = nil
+	proc.Stderr = nil
 	err = exec2.Start(proc)
 	if err != nil {
 		dbg.Fatalf("failed to spawn daemon: %v", err)
@@ -0,0 +1,26 @@
+//go:build darwin || ios
+
+// Log file details that differ between platforms
+package dbglog
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// When the file was created, or last modified if the filesystem doesn't say
+func created(f *os.File, fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Birthtimespec.Sec == 0 {
+		return fi.ModTime()
+	}
+	return time.Unix(st.Birthtimespec.Unix())
+}
+
+// Point fd 2 at f
+func dupStderr(f *os.File) error {
+	return unix.Dup2(int(f.Fd()), 2)
+}
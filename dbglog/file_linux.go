@@ -0,0 +1,24 @@
+// Log file details that differ between platforms
+package dbglog
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// When the file was created, or last modified if the filesystem doesn't say
+func created(f *os.File, fi os.FileInfo) time.Time {
+	var st unix.Statx_t
+	err := unix.Statx(int(f.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_BTIME, &st)
+	if err != nil || st.Mask&unix.STATX_BTIME == 0 {
+		return fi.ModTime()
+	}
+	return time.Unix(st.Btime.Sec, int64(st.Btime.Nsec))
+}
+
+// Point fd 2 at f
+func dupStderr(f *os.File) error {
+	return unix.Dup3(int(f.Fd()), 2, 0)
+}
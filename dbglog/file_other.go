@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !ios && !windows
+
+// Log file details that differ between platforms
+package dbglog
+
+import (
+	"os"
+	"time"
+)
+
+// Without a portable birth time, the last modification will have to do.
+func created(f *os.File, fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
+
+// Stderr is left alone.
+func dupStderr(f *os.File) error {
+	return nil
+}
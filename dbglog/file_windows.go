@@ -0,0 +1,21 @@
+// Log file details that differ between platforms
+package dbglog
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// When the file was created, or last modified if the filesystem doesn't say
+func created(f *os.File, fi os.FileInfo) time.Time {
+	if d, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, d.CreationTime.Nanoseconds())
+	}
+	return fi.ModTime()
+}
+
+// Windows has no fd 2 to point at the file; stderr is left alone.
+func dupStderr(f *os.File) error {
+	return nil
+}
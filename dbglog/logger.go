@@ -1,29 +1,244 @@
+// Leveled logging.  All loggers share one output (see output.go).
+// WithPrefix derives a logger with a longer prefix; Subsystem does the
+// same and gives the new logger a level of its own, which can be set by
+// name with SetSubsystemLevel before or after the logger exists.
 package dbglog
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type Level int32
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+// Level of loggers that follow their parent's
+const levelUnset Level = -1
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		return LevelWarn, nil
+	}
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return LevelError, fmt.Errorf("unknown log level %q", name)
+}
+
+// A level that may change while loggers are in use
+type levelVar struct {
+	v int32
+}
+
+func newLevelVar(l Level) *levelVar {
+	return &levelVar{v: int32(l)}
+}
+
+func (lv *levelVar) get() Level {
+	return Level(atomic.LoadInt32(&lv.v))
+}
+
+func (lv *levelVar) set(l Level) {
+	atomic.StoreInt32(&lv.v, int32(l))
+}
+
+// Levels of named subsystems
+var subsystems = struct {
+	sync.Mutex
+	levels map[string]*levelVar
+}{levels: make(map[string]*levelVar)}
+
+func subsystemLevel(name string) *levelVar {
+	subsystems.Lock()
+	defer subsystems.Unlock()
+	lv, ok := subsystems.levels[name]
+	if !ok {
+		lv = newLevelVar(levelUnset)
+		subsystems.levels[name] = lv
+	}
+	return lv
+}
+
 type DbgLogger struct {
+	// The standard log methods (Printf, Println, ...) log at info level.
 	*log.Logger
-	Enable bool
+	// Nothing is logged while false, by this logger or those derived from it
+	Enable    bool
+	prefix    string
+	subsystem string
+	level     *levelVar // nil to follow the parent
+	parent    *DbgLogger
 }
 
-func (d *DbgLogger) Debug(format string, args ...interface{}) {
-	if d.Enable {
-		//msg := fmt.Sprintf(format, args...)
-		//fmt.Fprintf(os.Stderr, "[DEBUG] %s\n", msg)
-		d.Printf(" "+format, args...)
+func newLogger(parent *DbgLogger, prefix string) *DbgLogger {
+	d := &DbgLogger{Enable: true, prefix: prefix, parent: parent}
+	if parent != nil {
+		d.Enable = parent.Enable
+		d.subsystem = parent.subsystem
+	}
+	d.Logger = log.New(levelWriter{d, LevelInfo}, "", 0)
+	return d
+}
+
+// Is a message at level l logged?
+func (d *DbgLogger) Enabled(l Level) bool {
+	for p := d; p != nil; p = p.parent {
+		if !p.Enable {
+			return false
+		}
+	}
+	return l <= d.Level()
+}
+
+// The level in effect: this logger's own, or the nearest ancestor's
+func (d *DbgLogger) Level() Level {
+	for p := d; p != nil; p = p.parent {
+		if p.level == nil {
+			continue
+		}
+		if l := p.level.get(); l != levelUnset {
+			return l
+		}
 	}
+	return LevelDebug
 }
+
+// Set the level of this logger and those derived from it without a
+// level of their own
+func (d *DbgLogger) SetLevel(l Level) {
+	if d.level == nil {
+		d.level = newLevelVar(l)
+		return
+	}
+	d.level.set(l)
+}
+
+func (d *DbgLogger) logf(l Level, format string, args ...interface{}) {
+	if !d.Enabled(l) {
+		return
+	}
+	std.write(&entry{
+		time:      time.Now(),
+		level:     l,
+		prefix:    d.prefix,
+		subsystem: d.subsystem,
+		msg:       fmt.Sprintf(format, args...),
+	})
+}
+
+func (d *DbgLogger) Error(format string, args ...interface{}) {
+	d.logf(LevelError, format, args...)
+}
+
+func (d *DbgLogger) Warn(format string, args ...interface{}) {
+	d.logf(LevelWarn, format, args...)
+}
+
+func (d *DbgLogger) Info(format string, args ...interface{}) {
+	d.logf(LevelInfo, format, args...)
+}
+
+func (d *DbgLogger) Debug(format string, args ...interface{}) {
+	d.logf(LevelDebug, format, args...)
+}
+
+func (d *DbgLogger) Trace(format string, args ...interface{}) {
+	d.logf(LevelTrace, format, args...)
+}
+
+// Log an error and exit
+func (d *DbgLogger) Fatalf(format string, args ...interface{}) {
+	d.logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+// Append to this logger's prefix
 func (d *DbgLogger) NewPrefix(newprefix string) {
-	d.Logger = d.WithPrefix(newprefix).Logger
+	d.prefix += newprefix
+}
+
+// A logger whose messages carry an extra prefix.  It shares this logger's
+// output, level and Enable switch.
+func (d *DbgLogger) WithPrefix(newprefix string) *DbgLogger {
+	return newLogger(d, d.prefix+newprefix)
+}
+
+// A logger for the named subsystem, prefixed with "[name]" and with its
+// own level, which follows this logger's until set.
+func (d *DbgLogger) Subsystem(name string) *DbgLogger {
+	child := d.WithPrefix("[" + name + "]")
+	child.subsystem = name
+	child.level = subsystemLevel(name)
+	return child
+}
+
+// Set the level of a subsystem's loggers
+func SetSubsystemLevel(name string, l Level) {
+	subsystemLevel(name).set(l)
+}
+
+// Set levels from a list such as "info sftp=debug spawn=trace": a bare
+// level is the default, name=level sets a subsystem's.
+func SetLevels(spec string) error {
+	fields := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	for _, f := range fields {
+		name, levelName := "", f
+		if i := strings.Index(f, "="); i >= 0 {
+			name, levelName = f[:i], f[i+1:]
+		}
+		l, err := ParseLevel(levelName)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			dbg.SetLevel(l)
+		} else {
+			SetSubsystemLevel(name, l)
+		}
+	}
+	return nil
+}
+
+// Routes the standard log methods to a level
+type levelWriter struct {
+	d     *DbgLogger
+	level Level
 }
 
-func (d *DbgLogger) WithPrefix(newprefix string) DbgLogger {
-	return DbgLogger{log.New(os.Stderr, d.Prefix()+newprefix, d.Flags()|log.Lmsgprefix), true}
+func (w levelWriter) Write(p []byte) (int, error) {
+	w.d.logf(w.level, "%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
 }
 
-var dbg = &DbgLogger{log.New(os.Stderr, "[DEBUG]", log.LstdFlags|log.Lmsgprefix), true}
+var dbg = func() *DbgLogger {
+	d := newLogger(nil, "")
+	d.SetLevel(LevelDebug)
+	return d
+}()
 var Dbg = dbg
@@ -0,0 +1,191 @@
+// Where log entries go, and how they're written
+package dbglog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("unknown log format %q", name)
+}
+
+type entry struct {
+	time      time.Time
+	level     Level
+	prefix    string
+	subsystem string
+	msg       string
+}
+
+// A destination for formatted entries
+type target interface {
+	write(level Level, line []byte) error
+	close() error
+	// Does the target timestamp entries itself?
+	stamps() bool
+}
+
+// Plain writers: stderr and files
+type writerTarget struct {
+	w io.Writer
+}
+
+func (t writerTarget) write(level Level, line []byte) error {
+	_, err := t.w.Write(line)
+	return err
+}
+
+func (t writerTarget) close() error {
+	if t.w == os.Stderr || t.w == os.Stdout {
+		return nil
+	}
+	if c, ok := t.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (t writerTarget) stamps() bool {
+	return false
+}
+
+type output struct {
+	sync.Mutex
+	format Format
+	target target
+}
+
+var std = &output{target: writerTarget{os.Stderr}}
+
+func (o *output) encode(e *entry, stamped bool) []byte {
+	if o.format == FormatJSON {
+		line, _ := json.Marshal(struct {
+			Time      string `json:"time,omitempty"`
+			Level     string `json:"level"`
+			Subsystem string `json:"subsystem,omitempty"`
+			Prefix    string `json:"prefix,omitempty"`
+			Msg       string `json:"msg"`
+		}{
+			Time:      e.time.UTC().Format(time.RFC3339Nano),
+			Level:     e.level.String(),
+			Subsystem: e.subsystem,
+			Prefix:    e.prefix,
+			Msg:       e.msg,
+		})
+		return append(line, '\n')
+	}
+	var b strings.Builder
+	if !stamped {
+		b.WriteString(e.time.Format("2006/01/02 15:04:05 "))
+	}
+	b.WriteString("[" + strings.ToUpper(e.level.String()) + "]")
+	b.WriteString(e.prefix)
+	b.WriteString(" ")
+	b.WriteString(e.msg)
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+func (o *output) write(e *entry) {
+	o.Lock()
+	defer o.Unlock()
+	line := o.encode(e, o.target.stamps())
+	if err := o.target.write(e.level, line); err != nil && o.target.stamps() {
+		// Don't lose messages while syslog is unavailable.
+		os.Stderr.Write(o.encode(e, false))
+	}
+}
+
+func (o *output) setTarget(t target) {
+	o.Lock()
+	defer o.Unlock()
+	if err := o.target.close(); err != nil {
+		fmt.Fprintf(os.Stderr, "dbglog: error closing log output: %v\n", err)
+	}
+	o.target = t
+}
+
+// Write entries as text or JSON
+func SetFormat(f Format) {
+	std.Lock()
+	defer std.Unlock()
+	std.format = f
+}
+
+// Write entries to w
+func SetOutput(w io.Writer) {
+	std.setTarget(writerTarget{w})
+}
+
+// Append entries to the file at path
+func OpenFile(path string) error {
+	return OpenRotatingFile(path, Rotation{})
+}
+
+// Append entries to the file at path, rotating it as rot says
+func OpenRotatingFile(path string, rot Rotation) error {
+	f, err := openRotatingFile(path, rot)
+	if err != nil {
+		return err
+	}
+	std.setTarget(writerTarget{f})
+	return nil
+}
+
+// Reopen the log file, for example after logrotate has moved it.  Other
+// outputs are left alone.
+func Reopen() error {
+	std.Lock()
+	defer std.Unlock()
+	if f := std.file(); f != nil {
+		return f.reopen()
+	}
+	return nil
+}
+
+// Send stderr to the log file as well, following it through rotations and
+// reopens, so panics and other stray output land in the current file.
+func CaptureStderr() error {
+	std.Lock()
+	defer std.Unlock()
+	f := std.file()
+	if f == nil {
+		return errors.New("not logging to a file")
+	}
+	f.stderr = true
+	if f.f == nil {
+		// Done when it's next opened
+		return nil
+	}
+	return dupStderr(f.f)
+}
+
+// The log file, if that's where entries go
+func (o *output) file() *rotatingFile {
+	if t, ok := o.target.(writerTarget); ok {
+		if f, ok := t.w.(*rotatingFile); ok {
+			return f
+		}
+	}
+	return nil
+}
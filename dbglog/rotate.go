@@ -0,0 +1,224 @@
+// Log files rotated by size and age.  A rotated file is renamed to
+// path.YYYYMMDD-hhmmss.mmm, optionally gzipped, and the oldest are removed
+// beyond MaxBackups.
+package dbglog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405.000"
+
+type Rotation struct {
+	MaxSize    int64         // bytes; rotate before the file grows past this
+	MaxAge     time.Duration // rotate once the file is this old
+	MaxBackups int           // rotated files kept; 0 keeps them all
+	Compress   bool          // gzip rotated files
+}
+
+// Only used under the output's lock, except for the cleanup of rotated
+// files, which runs in the background.
+type rotatingFile struct {
+	path    string
+	rot     Rotation
+	f       *os.File
+	size    int64
+	opened  time.Time
+	stderr  bool // point fd 2 at each file we open
+	cleanup sync.Mutex
+}
+
+func openRotatingFile(path string, rot Rotation) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, rot: rot}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.size = 0
+	r.opened = time.Now()
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		// Age a file we're appending to from its creation, so restarts
+		// don't put off rotation.
+		r.size = fi.Size()
+		r.opened = created(f, fi)
+	}
+	if r.stderr {
+		if err := dupStderr(f); err != nil {
+			fmt.Fprintf(os.Stderr, "dbglog: error redirecting stderr to %s: %v\n", r.path, err)
+		}
+	}
+	r.f = f
+	return nil
+}
+
+// Is the file due for rotation before writing n more bytes?
+func (r *rotatingFile) due(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.rot.MaxSize > 0 && r.size+int64(n) > r.rot.MaxSize {
+		return true
+	}
+	return r.rot.MaxAge > 0 && time.Since(r.opened) >= r.rot.MaxAge
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "dbglog: error rotating %s: %v\n", r.path, err)
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// Close and open the path again, after something else has moved the file
+func (r *rotatingFile) reopen() error {
+	r.Close()
+	return r.open()
+}
+
+// Move the file aside and start a new one
+func (r *rotatingFile) rotate() error {
+	r.Close()
+	stamp := time.Now()
+	backup := r.path + "." + stamp.Format(backupTimeFormat)
+	for exists(backup) || exists(backup+".gz") {
+		stamp = stamp.Add(time.Millisecond)
+		backup = r.path + "." + stamp.Format(backupTimeFormat)
+	}
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	// Open the new file first, so stderr has moved off the backup before
+	// it's compressed or removed.
+	err := r.open()
+	go r.finish(backup)
+	return err
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Compress a rotated file and remove old ones
+func (r *rotatingFile) finish(backup string) {
+	r.cleanup.Lock()
+	defer r.cleanup.Unlock()
+	if r.rot.Compress {
+		if err := gzipFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "dbglog: error compressing %s: %v\n", backup, err)
+		}
+	}
+	if r.rot.MaxBackups <= 0 {
+		return
+	}
+	backups, err := r.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dbglog: error listing old logs: %v\n", err)
+		return
+	}
+	for len(backups) > r.rot.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "dbglog: error removing %s: %v\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// Rotated files, oldest first
+func (r *rotatingFile) backups() ([]string, error) {
+	dir, base := filepath.Split(r.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		stamp := strings.TrimSuffix(name[len(base)+1:], ".gz")
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	// The timestamps sort in time order, with or without ".gz".
+	sort.Slice(names, func(i, j int) bool {
+		return strings.TrimSuffix(names[i], ".gz") < strings.TrimSuffix(names[j], ".gz")
+	})
+	for i := range names {
+		names[i] = filepath.Join(dir, names[i])
+	}
+	return names, nil
+}
+
+// Replace path with path.gz
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	// Closed before removal, which windows requires
+	src.Close()
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,185 @@
+package dbglog
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wait for the background cleanup of rotated files to get where cond says
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openTestFile(t *testing.T, rot Rotation) (*rotatingFile, string) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	r, err := openRotatingFile(path, rot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, path
+}
+
+func writeLine(t *testing.T, r *rotatingFile, line string) {
+	t.Helper()
+	if _, err := r.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func backupCount(t *testing.T, r *rotatingFile) int {
+	backups, err := r.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(backups)
+}
+
+func TestRotateBySize(t *testing.T) {
+	r, path := openTestFile(t, Rotation{MaxSize: 20})
+	writeLine(t, r, "0123456789")
+	writeLine(t, r, "abcdefghij")
+	if n := backupCount(t, r); n != 1 {
+		t.Fatalf("%d backups, want 1", n)
+	}
+	if got := readFile(t, path); got != "abcdefghij\n" {
+		t.Errorf("current file = %q", got)
+	}
+	backups, _ := r.backups()
+	if got := readFile(t, backups[0]); got != "0123456789\n" {
+		t.Errorf("backup = %q", got)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	rot := Rotation{MaxAge: 100 * time.Millisecond}
+	r, path := openTestFile(t, rot)
+	writeLine(t, r, "first")
+	writeLine(t, r, "second")
+	if n := backupCount(t, r); n != 0 {
+		t.Fatalf("%d backups before MaxAge, want 0", n)
+	}
+	time.Sleep(2 * rot.MaxAge)
+	writeLine(t, r, "third")
+	if n := backupCount(t, r); n != 1 {
+		t.Fatalf("%d backups after MaxAge, want 1", n)
+	}
+	if got := readFile(t, path); got != "third\n" {
+		t.Errorf("current file = %q", got)
+	}
+}
+
+func TestRotateByAgeAcrossReopen(t *testing.T) {
+	rot := Rotation{MaxAge: 100 * time.Millisecond}
+	r, path := openTestFile(t, rot)
+	writeLine(t, r, "before restart")
+	r.Close()
+	time.Sleep(2 * rot.MaxAge)
+
+	// A restart must not make an old file look new.
+	r, err := openRotatingFile(path, rot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	writeLine(t, r, "after restart")
+	if n := backupCount(t, r); n != 1 {
+		t.Fatalf("%d backups, want 1", n)
+	}
+	if got := readFile(t, path); got != "after restart\n" {
+		t.Errorf("current file = %q", got)
+	}
+}
+
+func TestRotateKeepsMaxBackups(t *testing.T) {
+	r, _ := openTestFile(t, Rotation{MaxSize: 1, MaxBackups: 2})
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		writeLine(t, r, line)
+	}
+	waitFor(t, "old backups to be removed", func() bool {
+		r.cleanup.Lock()
+		defer r.cleanup.Unlock()
+		return backupCount(t, r) == 2
+	})
+	backups, _ := r.backups()
+	// The newest are kept.
+	if got := readFile(t, backups[0]) + readFile(t, backups[1]); got != "c\nd\n" {
+		t.Errorf("kept backups hold %q, want c and d", got)
+	}
+}
+
+func TestRotateCompresses(t *testing.T) {
+	r, _ := openTestFile(t, Rotation{MaxSize: 1, Compress: true})
+	writeLine(t, r, "compress me")
+	writeLine(t, r, "current")
+	var backup string
+	waitFor(t, "the backup to be compressed", func() bool {
+		r.cleanup.Lock()
+		defer r.cleanup.Unlock()
+		backups, err := r.backups()
+		if err != nil || len(backups) != 1 || !strings.HasSuffix(backups[0], ".gz") {
+			return false
+		}
+		backup = backups[0]
+		return true
+	})
+	if _, err := os.Stat(strings.TrimSuffix(backup, ".gz")); !os.IsNotExist(err) {
+		t.Errorf("uncompressed backup left behind: %v", err)
+	}
+	f, err := os.Open(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "compress me\n" {
+		t.Errorf("compressed backup = %q", data)
+	}
+}
+
+func TestReopenAfterMove(t *testing.T) {
+	r, path := openTestFile(t, Rotation{})
+	writeLine(t, r, "old")
+	moved := path + ".moved"
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	writeLine(t, r, "new")
+	if got := readFile(t, moved); got != "old\n" {
+		t.Errorf("moved file = %q", got)
+	}
+	if got := readFile(t, path); got != "new\n" {
+		t.Errorf("reopened file = %q", got)
+	}
+}
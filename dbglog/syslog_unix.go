@@ -0,0 +1,43 @@
+//go:build !windows
+
+// Logging to the local syslog daemon
+package dbglog
+
+import (
+	"log/syslog"
+)
+
+type syslogTarget struct {
+	w *syslog.Writer
+}
+
+func (t syslogTarget) write(level Level, line []byte) error {
+	msg := string(line)
+	switch level {
+	case LevelError:
+		return t.w.Err(msg)
+	case LevelWarn:
+		return t.w.Warning(msg)
+	case LevelInfo:
+		return t.w.Info(msg)
+	}
+	return t.w.Debug(msg)
+}
+
+func (t syslogTarget) close() error {
+	return t.w.Close()
+}
+
+func (t syslogTarget) stamps() bool {
+	return true
+}
+
+// Send entries to syslog over its local unix socket, tagged with tag
+func OpenSyslog(tag string) error {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return err
+	}
+	std.setTarget(syslogTarget{w})
+	return nil
+}
@@ -0,0 +1,10 @@
+// No syslog on windows
+package dbglog
+
+import (
+	"errors"
+)
+
+func OpenSyslog(tag string) error {
+	return errors.New("syslog is not supported on windows")
+}
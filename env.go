@@ -0,0 +1,171 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Session environment policy.  Children start from a configured base
+// environment rather than our own, and clients may only set variables
+// matching the AcceptEnv patterns that aren't on the deny list.
+package main
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Patterns of client variables accepted by default, as in sshd_config
+var defaultAcceptEnv = []string{"LANG", "LC_*"}
+
+// Patterns of client variables refused even when accepted, since they
+// change what the dynamic linker or the shell runs.
+var defaultDenyEnv = []string{
+	"LD_*",
+	"DYLD_*",
+	"BASH_ENV",
+	"BASH_FUNC_*",
+	"ENV",
+	"IFS",
+	"SHELLOPTS",
+	"BASHOPTS",
+	"PS4",
+	"GCONV_PATH",
+	"LOCPATH",
+}
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Environment children get when no base_environment is configured
+func defaultBaseEnv() []string {
+	if runtime.GOOS == "windows" {
+		// Too much of Windows breaks without SystemRoot and friends.
+		return os.Environ()
+	}
+	// A fixed PATH, not ours: nothing of the daemon's environment leaks in.
+	return []string{"PATH=" + defaultPath}
+}
+
+// Parse NAME=value lines, skipping blanks and # comments
+func parseEnvLines(data []byte) []string {
+	var env []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.IndexByte(line, '=') <= 0 {
+			dbg.Debug("Ignoring bad environment line: %q", line)
+			continue
+		}
+		env = append(env, line)
+	}
+	return env
+}
+
+// Set the base environment from the base_environment file
+func (s *Server) SetBaseEnv(envData []byte) {
+	s.BaseEnv = parseEnvLines(envData)
+}
+
+// Set the AcceptEnv patterns from whitespace separated data
+func (s *Server) SetAcceptEnv(patternData []byte) {
+	s.AcceptEnv = strings.Fields(string(patternData))
+}
+
+// Replace the deny list; an empty list denies nothing
+func (s *Server) SetDenyEnv(patternData []byte) {
+	s.DenyEnv = strings.Fields(string(patternData))
+}
+
+// May a client set the named variable?
+func (s *Server) acceptsEnv(name string) bool {
+	if name == "" || strings.IndexByte(name, '=') >= 0 {
+		return false
+	}
+	for _, pattern := range s.DenyEnv {
+		if wildcardMatch(pattern, name) {
+			return false
+		}
+	}
+	for _, pattern := range s.AcceptEnv {
+		if wildcardMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set variables in env, replacing any earlier value.  Not every child
+// goes through os/exec's deduplication, so don't leave duplicates.
+func mergeEnv(env []string, vars ...string) []string {
+	for _, kv := range vars {
+		eq := strings.IndexByte(kv, '=')
+		if eq <= 0 {
+			continue
+		}
+		name := kv[:eq+1]
+		out := env[:0]
+		for _, old := range env {
+			if !strings.HasPrefix(old, name) {
+				out = append(out, old)
+			}
+		}
+		env = append(out, kv)
+	}
+	return env
+}
+
+// Split an address into host and port strings
+func splitAddr(addr net.Addr) (string, string) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), "0"
+	}
+	return host, port
+}
+
+// Build the environment for a session's command.  Later sources win:
+// base, client, user config, key environment=, then the variables we
+// always set ourselves.
+func (conn *ServerConn) sessionEnv(sess *session, extraEnv ...string) []string {
+	env := mergeEnv(nil, conn.BaseEnv...)
+	env = mergeEnv(env, sess.env...)
+	if conn.user != nil {
+		env = mergeEnv(env, conn.user.Env...)
+	}
+	env = mergeEnv(env, conn.opts.Environment...)
+
+	remoteHost, remotePort := splitAddr(conn.RemoteAddr())
+	localHost, localPort := splitAddr(conn.LocalAddr())
+	login := conn.loginName()
+	env = mergeEnv(env,
+		"USER="+login,
+		"LOGNAME="+login,
+		"HOME="+conn.homeDir(),
+		"SHELL="+conn.shellExe(),
+		"SSH_CLIENT="+strings.Join([]string{remoteHost, remotePort, localPort}, " "),
+		"SSH_CONNECTION="+strings.Join([]string{remoteHost, remotePort, localHost, localPort}, " "))
+	if sess.pty != nil {
+		env = mergeEnv(env, "SSH_TTY="+sess.pty.Tty.Name())
+		if sess.term != "" {
+			env = mergeEnv(env, "TERM="+sess.term)
+		}
+	}
+	if sess.agent != nil {
+		env = mergeEnv(env, "SSH_AUTH_SOCK="+sess.agent.Addr().String())
+	}
+	if sess.x11 != nil {
+		env = mergeEnv(env, sess.x11.environ()...)
+	}
+	return mergeEnv(env, extraEnv...)
+}
@@ -226,7 +226,7 @@ func (c *Cmd) Start() error {
 }
 
 func PosixSpawn(cmd *Cmd) error {
-	dbg := dbglog.Dbg.WithPrefix("[spawn]")
+	dbg := dbglog.Dbg.Subsystem("spawn")
 	// int posix_spawn(pid_t *restrict pid, const char *restrict path,
 	//       const posix_spawn_file_actions_t *file_actions,
 	//       const posix_spawnattr_t *restrict attrp,
@@ -242,7 +242,9 @@ func PosixSpawn(cmd *Cmd) error {
 	if needSpawnHelper {
 		dbg.Debug("using spawnHelper!\n")
 		path, _ = os.Executable()
-		args = append([]string{path, "spawn", strconv.Itoa(cmd.SysProcAttr.Ctty)}, args...)
+		// The helper gets the real path as well, since argv[0] may be
+		// something else, such as a login shell's "-sh".
+		args = append([]string{path, "spawn", strconv.Itoa(cmd.SysProcAttr.Ctty), cmd.Path}, args...)
 		//path = "ptyspawn_helper"
 		//args = append([]string{path, strconv.Itoa(cmd.SysProcAttr.Ctty)}, args...)
 	}
@@ -265,7 +267,7 @@ func PosixSpawn(cmd *Cmd) error {
 	}()
 
 	var spenvp = make([]*C.char, len(envp)+1)
-	spenvp[len(args)] = nil
+	spenvp[len(envp)] = nil
 	for i, envEntry := range envp {
 		spenvp[i] = C.CString(envEntry)
 	}
@@ -466,6 +468,9 @@ func PosixSpawn(cmd *Cmd) error {
 	return err
 }
 
+// posix_spawn can't change the user, so SysProcAttr.Credential is ignored.
+const SupportsCredential = false
+
 func Start(cmd *exec.Cmd) error {
 	_cmd := (*Cmd)(unsafe.Pointer(cmd))
 	return _cmd.Start()
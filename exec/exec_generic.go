@@ -4,6 +4,9 @@ package exec
 
 import "os/exec"
 
+// os/exec starts commands with SysProcAttr.Credential's user and groups.
+const SupportsCredential = true
+
 func Start(cmd *exec.Cmd) error {
 	if err := cmd.Start(); err != nil {
 		return err
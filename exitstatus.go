@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Reporting how a session's command ended (RFC 4254 section 6.10).
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"os/exec"
+)
+
+// Status reported when the command could not be started at all
+const exitStatusNotStarted = 127
+
+// How a session's command ended
+type exitStatus struct {
+	Status     uint32
+	Signal     string // RFC 4254 signal name if killed by a signal
+	CoreDumped bool
+}
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// Work out the exit status from the error returned by running a command
+func exitStatusFromError(err error) exitStatus {
+	if err == nil {
+		return exitStatus{}
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return exitStatus{Status: exitStatusNotStarted}
+	}
+	st := exitStatus{Status: uint32(exitErr.ExitCode())}
+	if sig, core, ok := processSignal(exitErr.ProcessState); ok {
+		st.Signal = sig
+		st.CoreDumped = core
+	}
+	return st
+}
+
+// Tell the client how the command ended
+func (st exitStatus) send(ch ssh.Channel) error {
+	if st.Signal != "" {
+		_, err := ch.SendRequest("exit-signal", false, ssh.Marshal(&exitSignalMsg{
+			Signal:     st.Signal,
+			CoreDumped: st.CoreDumped,
+		}))
+		return err
+	}
+	_, err := ch.SendRequest("exit-status", false, ssh.Marshal(&exitStatusMsg{st.Status}))
+	return err
+}
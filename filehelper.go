@@ -0,0 +1,177 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// SCP and SFTP for logins that run as another account.  Served in-process
+// they would read and write files as us, so sshdog runs a copy of itself
+// under the account's uid and groups to serve them instead.  The copy's
+// audit events come back over a pipe and go into our audit log.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// First argument of a file helper's command line
+const fileHelperArg = "file-helper"
+
+// Serve SCP (args is the scp command line) or SFTP (args is "sftp") on ch
+// through a helper running as the connection's account
+func (conn *ServerConn) runFileHelper(ch ssh.Channel, args ...string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, append([]string{fileHelperArg}, args...)...)
+	// Nothing of ours in its environment; relative paths start at home.
+	cmd.Env = []string{}
+	cmd.Dir = conn.homeDir()
+	if _, err := os.Stat(cmd.Dir); cmd.Dir != "" && err != nil {
+		dbg.Debug("Could not use home directory: %v", err)
+		cmd.Dir = ""
+	}
+	if err := setCredential(cmd, conn.account); err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = ch
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	events, eventsW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+	cmd.ExtraFiles = []*os.File{eventsW}
+	err = cmd.Start()
+	eventsW.Close()
+	if err != nil {
+		return err
+	}
+	go func() {
+		// The client's EOF is the helper's EOF.
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayHelperLog(stderr)
+	}()
+	go func() {
+		defer wg.Done()
+		conn.relayHelperAudit(events)
+	}()
+	// Both pipes are read to the end before Wait closes them.
+	wg.Wait()
+	return cmd.Wait()
+}
+
+// Our log gets the helper's, at debug level
+func relayHelperLog(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		dbg.Debug("file helper: %s", scanner.Text())
+	}
+}
+
+// Pass on the helper's scp and sftp events as ours.  It runs as the
+// account, so nothing else it says is taken, and the time and connection
+// are our own.
+func (conn *ServerConn) relayHelperAudit(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var fields auditFields
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber()
+		if err := dec.Decode(&fields); err != nil {
+			dbg.Debug("Bad audit event from file helper: %v", err)
+			continue
+		}
+		event, _ := fields["event"].(string)
+		if event != "scp" && event != "sftp" {
+			dbg.Debug("Ignoring %q audit event from file helper.", event)
+			continue
+		}
+		delete(fields, "event")
+		delete(fields, "time")
+		delete(fields, "conn")
+		conn.audit(event, fields)
+	}
+}
+
+// The helper's stdin and stdout, standing in for the channel they carry
+type stdioChannel struct{}
+
+func (stdioChannel) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdioChannel) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdioChannel) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+func (stdioChannel) CloseWrite() error {
+	return os.Stdout.Close()
+}
+
+func (stdioChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, fmt.Errorf("file helper cannot send %s requests", name)
+}
+
+// Goes to the server's log, not the client
+func (stdioChannel) Stderr() io.ReadWriter {
+	return os.Stderr
+}
+
+// Serve one SCP or SFTP session on stdin and stdout as whoever started us,
+// with audit events written to fd 3.  Returns the exit code.
+func handleFileHelper(args []string) int {
+	dbg.NewPrefix("[FileHelper]")
+	server := NewServer()
+	server.auditLog = &auditLog{w: os.NewFile(3, "audit")}
+	conn := &ServerConn{Server: server}
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "sftp":
+		err = conn.SFTPHandler(stdioChannel{})
+	case len(args) > 0 && args[0] == "scp":
+		err = conn.SCPHandler(args, stdioChannel{})
+	default:
+		err = fmt.Errorf("unknown file helper command %q", args)
+	}
+	if err != nil {
+		dbg.Warn("%v", err)
+		return 1
+	}
+	return 0
+}
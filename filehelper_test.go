@@ -0,0 +1,55 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRelayHelperAudit(t *testing.T) {
+	out := &bytes.Buffer{}
+	conn := &ServerConn{Server: NewServer(), id: "ours"}
+	conn.auditLog = &auditLog{w: out}
+	events := strings.Join([]string{
+		`{"event":"sftp","conn":"forged","time":"1970-01-01T00:00:00Z","op":"transfer","bytes":9007199254740993}`,
+		`{"event":"auth","conn":"forged","user":"root","success":true}`,
+		`not json`,
+		`{"event":"scp","direction":"upload","path":"a.txt","success":true}`,
+	}, "\n")
+	conn.relayHelperAudit(strings.NewReader(events))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("relayed %d events, want 2:\n%s", len(lines), out)
+	}
+	var first map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(lines[0]))
+	dec.UseNumber()
+	if err := dec.Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if first["event"] != "sftp" || first["conn"] != "ours" || first["time"] == "1970-01-01T00:00:00Z" {
+		t.Errorf("relayed %v; want our connection and time", first)
+	}
+	if first["bytes"] != json.Number("9007199254740993") {
+		t.Errorf("bytes = %v, want it exact", first["bytes"])
+	}
+	if !strings.Contains(lines[1], `"event":"scp"`) {
+		t.Errorf("second event = %s, want the scp one", lines[1])
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Port forwarding: remote (ssh -R) TCP forwards and unix socket
+// (streamlocal) forwards in both directions.
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var fwdLog = dbg.Subsystem("forward")
+
+// Payload of tcpip-forward and cancel-tcpip-forward
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// Reply to tcpip-forward when port 0 was requested
+type tcpipForwardReply struct {
+	BindPort uint32
+}
+
+// Payload of streamlocal-forward@openssh.com and its cancel request
+type streamLocalForwardRequest struct {
+	SocketPath string
+}
+
+// Payload of direct-streamlocal@openssh.com channels
+type streamLocalMessage struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// Payload of forwarded-streamlocal@openssh.com channels
+type forwardedStreamLocalMessage struct {
+	SocketPath string
+	Reserved   string
+}
+
+// Set of listeners opened on behalf of the client
+type remoteForwards struct {
+	sync.Mutex
+	listeners map[string]net.Listener
+	closed    bool
+}
+
+func forwardKey(addr string, port uint32) string {
+	return net.JoinHostPort(addr, strconv.Itoa(int(port)))
+}
+
+func streamLocalKey(path string) string {
+	return "streamlocal:" + path
+}
+
+// Map the address the client asked for to one we can listen on
+func forwardBindAddr(addr string) string {
+	switch addr {
+	case "", "*", "0.0.0.0", "::":
+		return ""
+	default:
+		return addr
+	}
+}
+
+func (f *remoteForwards) add(key string, l net.Listener) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return false
+	}
+	if f.listeners == nil {
+		f.listeners = make(map[string]net.Listener)
+	}
+	if _, ok := f.listeners[key]; ok {
+		return false
+	}
+	f.listeners[key] = l
+	return true
+}
+
+func (f *remoteForwards) remove(key string) net.Listener {
+	f.Lock()
+	defer f.Unlock()
+	l := f.listeners[key]
+	delete(f.listeners, key)
+	return l
+}
+
+// Close all listeners and refuse any new ones
+func (f *remoteForwards) closeAll() {
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	for key, l := range f.listeners {
+		fwdLog.Debug("Closing remote forward on %s", key)
+		closeForwardListener(l)
+		delete(f.listeners, key)
+	}
+}
+
+// Handle a tcpip-forward global request
+func (conn *ServerConn) handleTCPIPForward(r *ssh.Request) {
+	var msg tcpipForwardRequest
+	if err := ssh.Unmarshal(r.Payload, &msg); err != nil {
+		fwdLog.Debug("Error unmarshaling tcpip-forward: %v", err)
+		r.Reply(false, nil)
+		return
+	}
+	if !conn.opts.permitsListen(msg.BindAddr, msg.BindPort) {
+		fwdLog.Debug("Remote forward on %s:%d refused by key options.", msg.BindAddr, msg.BindPort)
+		r.Reply(false, nil)
+		return
+	}
+	laddr := net.JoinHostPort(forwardBindAddr(msg.BindAddr), strconv.Itoa(int(msg.BindPort)))
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		fwdLog.Debug("Unable to listen for remote forward on %s: %v", laddr, err)
+		r.Reply(false, nil)
+		return
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	key := forwardKey(msg.BindAddr, port)
+	if !conn.forwards.add(key, l) {
+		fwdLog.Debug("Remote forward %s already exists or connection closed.", key)
+		l.Close()
+		r.Reply(false, nil)
+		return
+	}
+	fwdLog.Debug("Remote forward listening on %s", l.Addr())
+
+	var reply []byte
+	if msg.BindPort == 0 {
+		reply = ssh.Marshal(&tcpipForwardReply{port})
+	}
+	r.Reply(true, reply)
+
+	go conn.serveRemoteForward(l, msg.BindAddr, port)
+}
+
+// Handle a cancel-tcpip-forward global request
+func (conn *ServerConn) handleCancelTCPIPForward(r *ssh.Request) {
+	var msg tcpipForwardRequest
+	if err := ssh.Unmarshal(r.Payload, &msg); err != nil {
+		fwdLog.Debug("Error unmarshaling cancel-tcpip-forward: %v", err)
+		r.Reply(false, nil)
+		return
+	}
+	key := forwardKey(msg.BindAddr, msg.BindPort)
+	l := conn.forwards.remove(key)
+	if l == nil {
+		fwdLog.Debug("No remote forward for %s", key)
+		r.Reply(false, nil)
+		return
+	}
+	fwdLog.Debug("Cancelling remote forward on %s", key)
+	closeForwardListener(l)
+	r.Reply(true, nil)
+}
+
+// Close a forward listener.  Go unlinks the socket files of unix listeners
+// it created; anything at the path by then belongs to someone else.
+func closeForwardListener(l net.Listener) {
+	l.Close()
+}
+
+// Handle a streamlocal-forward@openssh.com global request
+func (conn *ServerConn) handleStreamLocalForward(r *ssh.Request) {
+	var msg streamLocalForwardRequest
+	if err := ssh.Unmarshal(r.Payload, &msg); err != nil {
+		fwdLog.Debug("Error unmarshaling streamlocal-forward: %v", err)
+		r.Reply(false, nil)
+		return
+	}
+	if conn.opts.NoPortForwarding {
+		fwdLog.Debug("Remote forward on %s refused by key options.", msg.SocketPath)
+		r.Reply(false, nil)
+		return
+	}
+	if switchesUser(conn.account) {
+		// The socket would be ours, not the account's.
+		fwdLog.Debug("Remote forward on %s refused: login runs as another account.", msg.SocketPath)
+		r.Reply(false, nil)
+		return
+	}
+	// An existing file at the path is never removed: it may belong to
+	// another daemon, and OpenSSH doesn't unlink by default either.
+	l, err := net.Listen("unix", msg.SocketPath)
+	if err != nil {
+		fwdLog.Debug("Unable to listen for remote forward on %s: %v", msg.SocketPath, err)
+		r.Reply(false, nil)
+		return
+	}
+	key := streamLocalKey(msg.SocketPath)
+	if !conn.forwards.add(key, l) {
+		fwdLog.Debug("Remote forward %s already exists or connection closed.", key)
+		closeForwardListener(l)
+		r.Reply(false, nil)
+		return
+	}
+	fwdLog.Debug("Remote forward listening on %s", msg.SocketPath)
+	r.Reply(true, nil)
+
+	go conn.serveStreamLocalForward(l, msg.SocketPath)
+}
+
+// Handle a cancel-streamlocal-forward@openssh.com global request
+func (conn *ServerConn) handleCancelStreamLocalForward(r *ssh.Request) {
+	var msg streamLocalForwardRequest
+	if err := ssh.Unmarshal(r.Payload, &msg); err != nil {
+		fwdLog.Debug("Error unmarshaling cancel-streamlocal-forward: %v", err)
+		r.Reply(false, nil)
+		return
+	}
+	key := streamLocalKey(msg.SocketPath)
+	l := conn.forwards.remove(key)
+	if l == nil {
+		fwdLog.Debug("No remote forward for %s", key)
+		r.Reply(false, nil)
+		return
+	}
+	fwdLog.Debug("Cancelling remote forward on %s", key)
+	closeForwardListener(l)
+	r.Reply(true, nil)
+}
+
+// Accept connections on a forwarded unix socket and hand them to the client
+func (conn *ServerConn) serveStreamLocalForward(l net.Listener, path string) {
+	payload := ssh.Marshal(&forwardedStreamLocalMessage{SocketPath: path})
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			fwdLog.Debug("Remote forward listener %s done: %v", path, err)
+			return
+		}
+		go func() {
+			defer c.Close()
+			conn.forwardToClient("forwarded-streamlocal@openssh.com", payload, c)
+		}()
+	}
+}
+
+// Handle a direct-streamlocal@openssh.com channel (ssh -L to a unix socket)
+func (conn *ServerConn) HandleStreamLocalChannel(wg *sync.WaitGroup, newChan ssh.NewChannel) {
+	defer wg.Done()
+	var msg streamLocalMessage
+	if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+		fwdLog.Debug("Unable to setup forwarding: %v", err)
+		newChan.Reject(ssh.ResourceShortage, "Error parsing message.")
+		return
+	}
+	fwdLog.Debug("Forwarding request: %v", msg)
+	if conn.opts.NoPortForwarding {
+		fwdLog.Debug("Forward to %s refused by key options.", msg.SocketPath)
+		newChan.Reject(ssh.Prohibited, "Port forwarding not permitted.")
+		return
+	}
+	if switchesUser(conn.account) {
+		// The socket's permissions would be checked against us.
+		fwdLog.Debug("Forward to %s refused: login runs as another account.", msg.SocketPath)
+		newChan.Reject(ssh.Prohibited, "Unix socket forwarding not permitted for this account.")
+		return
+	}
+
+	outbound, err := net.Dial("unix", msg.SocketPath)
+	if err != nil {
+		fwdLog.Debug("Unable to dial forward: %v", err)
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer outbound.Close()
+
+	conn.pipeForwardChannel(newChan, outbound, msg.SocketPath)
+	fwdLog.Debug("Closing forwarding request: %v", msg)
+}
+
+// Accept a direct forwarding channel and pipe it to an outbound connection
+func (conn *ServerConn) pipeForwardChannel(newChan ssh.NewChannel, outbound net.Conn, target string) {
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		fwdLog.Debug("Unable to accept chan: %v", err)
+		return
+	}
+	defer ch.Close()
+	began := time.Now()
+	conn.audit("forward_open", auditFields{"type": newChan.ChannelType(), "target": target})
+
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			default:
+				fwdLog.Debug("Unknown %s request: %s", newChan.ChannelType(), req.Type)
+				if req.WantReply {
+					req.Reply(false, []byte{})
+				}
+			}
+		}
+	}()
+	var received int64
+	copied := make(chan struct{})
+	go func() {
+		received, _ = io.Copy(ch, outbound)
+		close(copied)
+	}()
+	sent, _ := io.Copy(outbound, ch)
+	// Stop the other direction too, as before, but count what it moved.
+	ch.Close()
+	outbound.Close()
+	<-copied
+	conn.audit("forward_close", auditFields{
+		"type":           newChan.ChannelType(),
+		"target":         target,
+		"bytes_sent":     sent,
+		"bytes_received": received,
+		"duration":       time.Since(began).Seconds(),
+	})
+}
+
+// Accept connections on a forwarded listener and hand them to the client
+func (conn *ServerConn) serveRemoteForward(l net.Listener, bindAddr string, bindPort uint32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			fwdLog.Debug("Remote forward listener %s done: %v", l.Addr(), err)
+			return
+		}
+		go func() {
+			defer c.Close()
+			origAddr, origPortStr, _ := net.SplitHostPort(c.RemoteAddr().String())
+			origPort, _ := strconv.Atoi(origPortStr)
+			payload := ssh.Marshal(&tcpipMessage{
+				Host:       bindAddr,
+				Port:       bindPort,
+				SourceIP:   origAddr,
+				SourcePort: uint32(origPort),
+			})
+			conn.forwardToClient("forwarded-tcpip", payload, c)
+		}()
+	}
+}
+
+// Open a channel of the given type back to the client and pipe c through it
+func (conn *ServerConn) forwardToClient(chanType string, payload []byte, c net.Conn) {
+	ch, reqs, err := conn.OpenChannel(chanType, payload)
+	if err != nil {
+		fwdLog.Debug("Unable to open %s channel: %v", chanType, err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	began := time.Now()
+	conn.audit("forward_open", auditFields{
+		"type":   chanType,
+		"local":  c.LocalAddr().String(),
+		"origin": c.RemoteAddr().String(),
+	})
+
+	var received int64
+	done := make(chan struct{})
+	go func() {
+		received, _ = io.Copy(ch, c)
+		ch.CloseWrite()
+		close(done)
+	}()
+	sent, _ := io.Copy(c, ch)
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	<-done
+	fwdLog.Debug("Closing %s channel from %s", chanType, c.RemoteAddr())
+	conn.audit("forward_close", auditFields{
+		"type":           chanType,
+		"local":          c.LocalAddr().String(),
+		"origin":         c.RemoteAddr().String(),
+		"bytes_sent":     sent,
+		"bytes_received": received,
+		"duration":       time.Since(began).Seconds(),
+	})
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Host key generation and persistence.
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Host keys we generate when none are configured
+var generatedKeyNames = []string{
+	"ssh_host_ed25519_key",
+	"ssh_host_ecdsa_key",
+	"ssh_host_rsa_key",
+}
+
+// Generate a new private key of the type implied by its file name
+func generateHostKey(keyName string) (crypto.Signer, error) {
+	switch keyName {
+	case "ssh_host_ed25519_key":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ssh_host_ecdsa_key":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ssh_host_rsa_key":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("Unable to generate %s", keyName)
+}
+
+// Use a host key and log its fingerprint
+func (s *Server) addHostSigner(signer ssh.Signer) {
+	pub := signer.PublicKey()
+	dbg.Debug("Host key: %s %s", pub.Type(), ssh.FingerprintSHA256(pub))
+	s.ServerConfig.AddHostKey(signer)
+	s.hostSigners = append(s.hostSigners, signer)
+}
+
+// Offer a host certificate for one of our host keys.  The plain key stays
+// available for clients that don't trust the host CA.
+func (s *Server) AddHostCertificate(certData []byte) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("Not a certificate.")
+	}
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("Certificate %q is not a host certificate.", cert.KeyId)
+	}
+	keyBytes := cert.Key.Marshal()
+	for _, signer := range s.hostSigners {
+		if !bytes.Equal(signer.PublicKey().Marshal(), keyBytes) {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return err
+		}
+		dbg.Debug("Host certificate: %s %q", cert.Type(), cert.KeyId)
+		s.ServerConfig.AddHostKey(certSigner)
+		return nil
+	}
+	return fmt.Errorf("No host key matches certificate %q.", cert.KeyId)
+}
+
+// Generate a fresh set of host keys that only live as long as the process
+func (s *Server) RandomHostkey() error {
+	for _, keyName := range generatedKeyNames {
+		key, err := generateHostKey(keyName)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			return err
+		}
+		s.addHostSigner(signer)
+	}
+	return nil
+}
+
+// Load host keys from stateDir, generating and saving any that are missing
+func (s *Server) PersistentHostkeys(stateDir string) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	for _, keyName := range generatedKeyNames {
+		keyPath := filepath.Join(stateDir, keyName)
+		if keyData, err := ioutil.ReadFile(keyPath); err == nil {
+			dbg.Debug("Loading hostkey file: %s", keyPath)
+			if err := s.AddHostkey(keyData); err != nil {
+				return fmt.Errorf("%s: %v", keyPath, err)
+			}
+			if certData, err := ioutil.ReadFile(keyPath + "-cert.pub"); err == nil {
+				if err := s.AddHostCertificate(certData); err != nil {
+					dbg.Debug("Error adding host certificate: %v", err)
+				}
+			}
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		dbg.Debug("Generating hostkey file: %s", keyPath)
+		key, err := generateHostKey(keyName)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			return err
+		}
+		if err := saveHostKey(keyPath, key, signer.PublicKey()); err != nil {
+			return err
+		}
+		s.addHostSigner(signer)
+	}
+	return nil
+}
+
+// Write a private key as PKCS#8 PEM, plus the public half in a .pub file
+func saveHostKey(keyPath string, key crypto.Signer, pub ssh.PublicKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyPath, keyData, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(pub), 0644)
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Pre-authentication banner and the message of the day.  The motd is a
+// text/template, for example:
+//
+//	Welcome to {{.Hostname}}, {{.User}} (connected from {{.ClientAddr}}).
+//	{{if not .LastLogin.IsZero}}Last login: {{.LastLogin.Format "Mon Jan 2 15:04:05 2006"}} from {{.LastLoginFrom}}
+//	{{end}}sshdog {{.Version}}, up {{.Uptime}}
+package main
+
+import (
+	"bytes"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Values available to the motd template
+type motdData struct {
+	Hostname      string
+	User          string
+	ClientAddr    string
+	LastLogin     time.Time // zero on the first login
+	LastLoginFrom string
+	Uptime        time.Duration
+	Version       string
+}
+
+type loginRecord struct {
+	When time.Time
+	From string
+}
+
+// Last interactive login of each user since we started
+type lastLog struct {
+	sync.Mutex
+	records map[string]loginRecord
+}
+
+// Record a login, returning the one before it
+func (l *lastLog) swap(name string, rec loginRecord) loginRecord {
+	l.Lock()
+	defer l.Unlock()
+	if l.records == nil {
+		l.records = make(map[string]loginRecord)
+	}
+	prev := l.records[name]
+	l.records[name] = rec
+	return prev
+}
+
+// Show the banner to clients before they authenticate
+func (s *Server) SetBanner(banner []byte) {
+	if len(banner) == 0 {
+		return
+	}
+	text := string(banner)
+	s.ServerConfig.BannerCallback = func(ssh.ConnMetadata) string {
+		return text
+	}
+}
+
+// Parse the motd template shown at the start of interactive shells
+func (s *Server) SetMotd(motd []byte) error {
+	tmpl, err := template.New("motd").Parse(string(motd))
+	if err != nil {
+		return err
+	}
+	s.motd = tmpl
+	return nil
+}
+
+// Write the motd to the session, recording the login either way
+func (conn *ServerConn) writeMotd(sess *session) {
+	user := conn.loginName()
+	remote := conn.RemoteAddr().String()
+	last := conn.lastLogins.swap(user, loginRecord{time.Now(), remote})
+	if conn.motd == nil {
+		return
+	}
+	hostname, _ := os.Hostname()
+	data := &motdData{
+		Hostname:      hostname,
+		User:          user,
+		ClientAddr:    remote,
+		LastLogin:     last.When,
+		LastLoginFrom: last.From,
+		Uptime:        time.Since(conn.started).Round(time.Second),
+		Version:       version,
+	}
+	buf := &bytes.Buffer{}
+	if err := conn.motd.Execute(buf, data); err != nil {
+		dbg.Debug("Error rendering motd: %v", err)
+		return
+	}
+	text := buf.String()
+	if sess.pty != nil {
+		// Nothing translates newlines on the way to the client's terminal.
+		text = strings.Replace(text, "\n", "\r\n", -1)
+	}
+	io.WriteString(sess.ch, text)
+}
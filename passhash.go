@@ -0,0 +1,236 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Password hash verification.  Supported formats are bcrypt ($2a$, $2b$,
+// $2y$), sha512-crypt ($6$) and scrypt in PHC string format
+// ($scrypt$ln=N,r=R,p=P$salt$hash, unpadded base64).
+package main
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownHashFormat = errors.New("Unknown password hash format.")
+
+// Hash used to spend comparable time on unknown users ("password", cost 10)
+const dummyPasswordHash = "$2a$10$p4mjZbEHUAce2R3RZ52S2.kxxpMOPajV7DejK3P6eDLoxgFUgxWya"
+
+// Check a password against a stored hash in constant time
+func checkPasswordHash(hash string, password []byte) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$6$"):
+		computed, err := sha512Crypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return checkScryptHash(hash, password)
+	}
+	return false, ErrUnknownHashFormat
+}
+
+// Check a $scrypt$ln=N,r=R,p=P$salt$hash string
+func checkScryptHash(hash string, password []byte) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return false, fmt.Errorf("malformed scrypt hash")
+	}
+	var ln, r, p int
+	for _, param := range strings.Split(parts[2], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return false, fmt.Errorf("malformed scrypt parameter %q", param)
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return false, err
+		}
+		switch kv[0] {
+		case "ln":
+			ln = v
+		case "r":
+			r = v
+		case "p":
+			p = v
+		default:
+			return false, fmt.Errorf("unknown scrypt parameter %q", kv[0])
+		}
+	}
+	if ln <= 0 || ln >= 32 || r <= 0 || p <= 0 {
+		return false, fmt.Errorf("invalid scrypt parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, err
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	computed, err := scrypt.Key(password, salt, 1<<uint(ln), r, p, len(expected))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(computed, expected) == 1, nil
+}
+
+const (
+	sha512CryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSalt       = 16
+)
+
+// Byte order of the final sha512-crypt encoding
+var sha512CryptPermutation = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// Repeat digest until it covers n bytes
+func repeatDigest(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out)+len(digest) <= n {
+		out = append(out, digest...)
+	}
+	return append(out, digest[:n-len(out)]...)
+}
+
+// Compute sha512-crypt of password using the salt and rounds from setting,
+// which is either a full hash or just its "$6$[rounds=N$]salt" prefix.
+// See https://www.akkadia.org/drepper/SHA-crypt.txt
+func sha512Crypt(password []byte, setting string) (string, error) {
+	if !strings.HasPrefix(setting, "$6$") {
+		return "", ErrUnknownHashFormat
+	}
+	rest := setting[3:]
+	rounds := sha512CryptDefaultRounds
+	customRounds := false
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.IndexByte(rest, '$')
+		if end < 0 {
+			return "", fmt.Errorf("malformed sha512-crypt hash")
+		}
+		n, err := strconv.Atoi(rest[len("rounds="):end])
+		if err != nil {
+			return "", err
+		}
+		if n < sha512CryptMinRounds {
+			n = sha512CryptMinRounds
+		} else if n > sha512CryptMaxRounds {
+			n = sha512CryptMaxRounds
+		}
+		rounds = n
+		customRounds = true
+		rest = rest[end+1:]
+	}
+	salt := rest
+	if end := strings.IndexByte(salt, '$'); end >= 0 {
+		salt = salt[:end]
+	}
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+	saltBytes := []byte(salt)
+
+	h := sha512.New()
+	h.Write(password)
+	h.Write(saltBytes)
+	h.Write(password)
+	altDigest := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(saltBytes)
+	h.Write(repeatDigest(altDigest, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(altDigest)
+		} else {
+			h.Write(password)
+		}
+	}
+	digest := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	pBytes := repeatDigest(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		h.Write(saltBytes)
+	}
+	sBytes := repeatDigest(h.Sum(nil), len(saltBytes))
+
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(digest)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(pBytes)
+		}
+		digest = h.Sum(digest[:0])
+	}
+
+	out := &strings.Builder{}
+	out.WriteString("$6$")
+	if customRounds {
+		fmt.Fprintf(out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	encode := func(w uint, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(sha512CryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, idx := range sha512CryptPermutation {
+		encode(uint(digest[idx[0]])<<16|uint(digest[idx[1]])<<8|uint(digest[idx[2]]), 4)
+	}
+	encode(uint(digest[63]), 2)
+	return out.String(), nil
+}
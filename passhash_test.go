@@ -0,0 +1,77 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt
+var sha512CryptVectors = []struct {
+	setting, password, hash string
+}{
+	{
+		"$6$saltstring",
+		"Hello world!",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	},
+	{
+		"$6$rounds=10000$saltstringsaltstring",
+		"Hello world!",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	},
+	{
+		"$6$rounds=5000$toolongsaltstring",
+		"This is just a test",
+		"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+	},
+}
+
+func TestSha512Crypt(t *testing.T) {
+	for _, v := range sha512CryptVectors {
+		got, err := sha512Crypt([]byte(v.password), v.setting)
+		if err != nil {
+			t.Errorf("sha512Crypt(%q): %v", v.setting, err)
+			continue
+		}
+		if got != v.hash {
+			t.Errorf("sha512Crypt(%q) = %q, want %q", v.setting, got, v.hash)
+		}
+	}
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	vectors := []struct {
+		hash, password string
+	}{
+		{sha512CryptVectors[0].hash, sha512CryptVectors[0].password},
+		{sha512CryptVectors[1].hash, sha512CryptVectors[1].password},
+		// From the OpenBSD bcrypt test set
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		// RFC 7914 section 12, in PHC string format
+		{"$scrypt$ln=10,r=8,p=16$TmFDbA$/bq+HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA", "password"},
+	}
+	for _, v := range vectors {
+		if ok, err := checkPasswordHash(v.hash, []byte(v.password)); !ok || err != nil {
+			t.Errorf("checkPasswordHash(%q, %q) = %v, %v; want true", v.hash, v.password, ok, err)
+		}
+		if ok, err := checkPasswordHash(v.hash, []byte(v.password+"x")); ok || err != nil {
+			t.Errorf("checkPasswordHash(%q, wrong password) = %v, %v; want false", v.hash, ok, err)
+		}
+	}
+	if _, err := checkPasswordHash("$1$md5$unsupported", []byte("x")); err != ErrUnknownHashFormat {
+		t.Errorf("unknown format: got %v, want ErrUnknownHashFormat", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Encoded terminal modes, as sent in pty-req (RFC 4254 section 8).
+package pty
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Opcodes from RFC 4254 section 8 and RFC 8160
+const (
+	TTY_OP_END = 0
+
+	VINTR    = 1
+	VQUIT    = 2
+	VERASE   = 3
+	VKILL    = 4
+	VEOF     = 5
+	VEOL     = 6
+	VEOL2    = 7
+	VSTART   = 8
+	VSTOP    = 9
+	VSUSP    = 10
+	VDSUSP   = 11
+	VREPRINT = 12
+	VWERASE  = 13
+	VLNEXT   = 14
+	VFLUSH   = 15
+	VSWTCH   = 16
+	VSTATUS  = 17
+	VDISCARD = 18
+
+	IGNPAR  = 30
+	PARMRK  = 31
+	INPCK   = 32
+	ISTRIP  = 33
+	INLCR   = 34
+	IGNCR   = 35
+	ICRNL   = 36
+	IUCLC   = 37
+	IXON    = 38
+	IXANY   = 39
+	IXOFF   = 40
+	IMAXBEL = 41
+	IUTF8   = 42
+
+	ISIG    = 50
+	ICANON  = 51
+	XCASE   = 52
+	ECHO    = 53
+	ECHOE   = 54
+	ECHOK   = 55
+	ECHONL  = 56
+	NOFLSH  = 57
+	TOSTOP  = 58
+	IEXTEN  = 59
+	ECHOCTL = 60
+	ECHOKE  = 61
+	PENDIN  = 62
+
+	OPOST  = 70
+	OLCUC  = 71
+	ONLCR  = 72
+	OCRNL  = 73
+	ONOCR  = 74
+	ONLRET = 75
+
+	CS7    = 90
+	CS8    = 91
+	PARENB = 92
+	PARODD = 93
+
+	TTY_OP_ISPEED = 128
+	TTY_OP_OSPEED = 129
+)
+
+// Character value meaning "disabled" on the wire
+const sshVDisable = 255
+
+// One opcode/argument pair
+type TerminalMode struct {
+	Opcode uint8
+	Value  uint32
+}
+
+// Decode the encoded terminal modes string of a pty-req.  Parsing stops
+// at TTY_OP_END or at the first opcode in the undefined 160-255 range,
+// whose argument format is unknown.
+func DecodeModes(modes []byte) ([]TerminalMode, error) {
+	var decoded []TerminalMode
+	for len(modes) > 0 {
+		opcode := modes[0]
+		if opcode == TTY_OP_END || opcode >= 160 {
+			break
+		}
+		if len(modes) < 5 {
+			return decoded, fmt.Errorf("truncated terminal mode %d", opcode)
+		}
+		decoded = append(decoded, TerminalMode{opcode, binary.BigEndian.Uint32(modes[1:5])})
+		modes = modes[5:]
+	}
+	return decoded, nil
+}
+
+// Apply terminal modes to the slave side of the pty.  Modes this platform
+// doesn't know are skipped.
+func (pty *Pty) SetModes(modes []TerminalMode) error {
+	return set_modes(pty.Tty, modes)
+}
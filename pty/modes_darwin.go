@@ -0,0 +1,93 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pty
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+type tcflag = uint64
+
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+	posixVDisable   = 0xff
+)
+
+var ccModes = map[uint8]int{
+	VINTR:    unix.VINTR,
+	VQUIT:    unix.VQUIT,
+	VERASE:   unix.VERASE,
+	VKILL:    unix.VKILL,
+	VEOF:     unix.VEOF,
+	VEOL:     unix.VEOL,
+	VEOL2:    unix.VEOL2,
+	VSTART:   unix.VSTART,
+	VSTOP:    unix.VSTOP,
+	VSUSP:    unix.VSUSP,
+	VDSUSP:   unix.VDSUSP,
+	VREPRINT: unix.VREPRINT,
+	VWERASE:  unix.VWERASE,
+	VLNEXT:   unix.VLNEXT,
+	VSTATUS:  unix.VSTATUS,
+	VDISCARD: unix.VDISCARD,
+}
+
+var iflagModes = map[uint8]tcflag{
+	IGNPAR:  unix.IGNPAR,
+	PARMRK:  unix.PARMRK,
+	INPCK:   unix.INPCK,
+	ISTRIP:  unix.ISTRIP,
+	INLCR:   unix.INLCR,
+	IGNCR:   unix.IGNCR,
+	ICRNL:   unix.ICRNL,
+	IXON:    unix.IXON,
+	IXANY:   unix.IXANY,
+	IXOFF:   unix.IXOFF,
+	IMAXBEL: unix.IMAXBEL,
+	IUTF8:   unix.IUTF8,
+}
+
+var lflagModes = map[uint8]tcflag{
+	ISIG:    unix.ISIG,
+	ICANON:  unix.ICANON,
+	ECHO:    unix.ECHO,
+	ECHOE:   unix.ECHOE,
+	ECHOK:   unix.ECHOK,
+	ECHONL:  unix.ECHONL,
+	NOFLSH:  unix.NOFLSH,
+	TOSTOP:  unix.TOSTOP,
+	IEXTEN:  unix.IEXTEN,
+	ECHOCTL: unix.ECHOCTL,
+	ECHOKE:  unix.ECHOKE,
+	PENDIN:  unix.PENDIN,
+}
+
+var oflagModes = map[uint8]tcflag{
+	OPOST:  unix.OPOST,
+	ONLCR:  unix.ONLCR,
+	OCRNL:  unix.OCRNL,
+	ONOCR:  unix.ONOCR,
+	ONLRET: unix.ONLRET,
+}
+
+// BSD termios stores speeds as plain numbers
+func setSpeed(t *unix.Termios, input bool, baud uint32) {
+	if input {
+		t.Ispeed = uint64(baud)
+	} else {
+		t.Ospeed = uint64(baud)
+	}
+}
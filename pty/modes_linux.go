@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pty
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+type tcflag = uint32
+
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+	posixVDisable   = 0
+)
+
+var ccModes = map[uint8]int{
+	VINTR:    unix.VINTR,
+	VQUIT:    unix.VQUIT,
+	VERASE:   unix.VERASE,
+	VKILL:    unix.VKILL,
+	VEOF:     unix.VEOF,
+	VEOL:     unix.VEOL,
+	VEOL2:    unix.VEOL2,
+	VSTART:   unix.VSTART,
+	VSTOP:    unix.VSTOP,
+	VSUSP:    unix.VSUSP,
+	VREPRINT: unix.VREPRINT,
+	VWERASE:  unix.VWERASE,
+	VLNEXT:   unix.VLNEXT,
+	VSWTCH:   unix.VSWTC,
+	VDISCARD: unix.VDISCARD,
+}
+
+var iflagModes = map[uint8]tcflag{
+	IGNPAR:  unix.IGNPAR,
+	PARMRK:  unix.PARMRK,
+	INPCK:   unix.INPCK,
+	ISTRIP:  unix.ISTRIP,
+	INLCR:   unix.INLCR,
+	IGNCR:   unix.IGNCR,
+	ICRNL:   unix.ICRNL,
+	IUCLC:   unix.IUCLC,
+	IXON:    unix.IXON,
+	IXANY:   unix.IXANY,
+	IXOFF:   unix.IXOFF,
+	IMAXBEL: unix.IMAXBEL,
+	IUTF8:   unix.IUTF8,
+}
+
+var lflagModes = map[uint8]tcflag{
+	ISIG:    unix.ISIG,
+	ICANON:  unix.ICANON,
+	XCASE:   unix.XCASE,
+	ECHO:    unix.ECHO,
+	ECHOE:   unix.ECHOE,
+	ECHOK:   unix.ECHOK,
+	ECHONL:  unix.ECHONL,
+	NOFLSH:  unix.NOFLSH,
+	TOSTOP:  unix.TOSTOP,
+	IEXTEN:  unix.IEXTEN,
+	ECHOCTL: unix.ECHOCTL,
+	ECHOKE:  unix.ECHOKE,
+	PENDIN:  unix.PENDIN,
+}
+
+var oflagModes = map[uint8]tcflag{
+	OPOST:  unix.OPOST,
+	OLCUC:  unix.OLCUC,
+	ONLCR:  unix.ONLCR,
+	OCRNL:  unix.OCRNL,
+	ONOCR:  unix.ONOCR,
+	ONLRET: unix.ONLRET,
+}
+
+var baudRates = map[uint32]tcflag{
+	50:      unix.B50,
+	75:      unix.B75,
+	110:     unix.B110,
+	134:     unix.B134,
+	150:     unix.B150,
+	200:     unix.B200,
+	300:     unix.B300,
+	600:     unix.B600,
+	1200:    unix.B1200,
+	1800:    unix.B1800,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	2000000: unix.B2000000,
+	4000000: unix.B4000000,
+}
+
+// Linux keeps a single speed in the CBAUD bits of c_cflag; the input
+// speed follows the output speed.
+func setSpeed(t *unix.Termios, input bool, baud uint32) {
+	speed, ok := baudRates[baud]
+	if !ok {
+		return
+	}
+	if input {
+		t.Ispeed = speed
+		return
+	}
+	t.Cflag = t.Cflag&^unix.CBAUD | speed
+	t.Ospeed = speed
+}
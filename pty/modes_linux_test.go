@@ -0,0 +1,64 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pty
+
+import (
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+func TestSetModesOnPty(t *testing.T) {
+	p, err := OpenPty()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer p.Close()
+	modes, err := DecodeModes(openSSHModes(t))
+	if err != nil {
+		t.Fatalf("DecodeModes: %v", err)
+	}
+	// Flip what OpenSSH sent so the pty's defaults can't pass for success.
+	modes = append(modes,
+		TerminalMode{VINTR, 7},
+		TerminalMode{VERASE, 8},
+		TerminalMode{ECHO, 0},
+		TerminalMode{IUTF8, 1},
+	)
+	if err := p.SetModes(modes); err != nil {
+		t.Fatalf("SetModes: %v", err)
+	}
+	tio, err := unix.IoctlGetTermios(int(p.Tty.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatalf("TCGETS: %v", err)
+	}
+	if tio.Cc[unix.VINTR] != 7 {
+		t.Errorf("VINTR = %d, want 7", tio.Cc[unix.VINTR])
+	}
+	if tio.Cc[unix.VERASE] != 8 {
+		t.Errorf("VERASE = %d, want 8", tio.Cc[unix.VERASE])
+	}
+	if tio.Lflag&unix.ECHO != 0 {
+		t.Error("ECHO still set")
+	}
+	if tio.Iflag&unix.IUTF8 == 0 {
+		t.Error("IUTF8 not set")
+	}
+	if tio.Lflag&unix.ICANON == 0 {
+		t.Error("ICANON from the OpenSSH modes not set")
+	}
+	if tio.Cc[unix.VEOL] != posixVDisable {
+		t.Errorf("VEOL = %d, want disabled", tio.Cc[unix.VEOL])
+	}
+}
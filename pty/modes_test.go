@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pty
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Modes sent by OpenSSH 9.2p1 ("ssh -tt" from an xterm-like terminal)
+const openSSHModesHex = "810000960080000096000100000003020000001c030000007f04000000150500" +
+	"00000406000000ff07000000ff080000001109000000130a0000001a0c000000" +
+	"120d000000170e00000016120000000f1e000000001f00000000200000000021" +
+	"0000000022000000002300000000240000000125000000002600000001270000" +
+	"0000280000000029000000002a00000000320000000133000000013400000000" +
+	"350000000136000000013700000001380000000039000000003a000000003b00" +
+	"0000013c000000013d000000013e000000004600000001470000000048000000" +
+	"0149000000004a000000004b000000005a000000015b000000015c000000005d" +
+	"0000000000"
+
+func openSSHModes(t *testing.T) []byte {
+	blob, err := hex.DecodeString(openSSHModesHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func modeMap(modes []TerminalMode) map[uint8]uint32 {
+	m := make(map[uint8]uint32)
+	for _, mode := range modes {
+		m[mode.Opcode] = mode.Value
+	}
+	return m
+}
+
+func TestDecodeOpenSSHModes(t *testing.T) {
+	modes, err := DecodeModes(openSSHModes(t))
+	if err != nil {
+		t.Fatalf("DecodeModes: %v", err)
+	}
+	if len(modes) != 52 {
+		t.Errorf("decoded %d modes, want 52", len(modes))
+	}
+	if modes[0] != (TerminalMode{TTY_OP_OSPEED, 38400}) {
+		t.Errorf("first mode = %v, want OSPEED 38400", modes[0])
+	}
+	want := map[uint8]uint32{
+		VINTR:  3,
+		VERASE: 0x7f,
+		VEOL:   sshVDisable,
+		ICRNL:  1,
+		IUTF8:  0,
+		ECHO:   1,
+		ICANON: 1,
+		ONLCR:  1,
+		CS8:    1,
+	}
+	got := modeMap(modes)
+	for opcode, value := range want {
+		if v, ok := got[opcode]; !ok || v != value {
+			t.Errorf("opcode %d = %d (present %v), want %d", opcode, v, ok, value)
+		}
+	}
+}
+
+func TestDecodeTruncatedModes(t *testing.T) {
+	blob := openSSHModes(t)
+	// Cut the last mode (PARODD) short.
+	modes, err := DecodeModes(blob[:len(blob)-3])
+	if err == nil {
+		t.Fatal("DecodeModes accepted a truncated blob")
+	}
+	if len(modes) != 51 {
+		t.Errorf("decoded %d modes before the truncation, want 51", len(modes))
+	}
+}
+
+func TestDecodeStopsAtUnknownOpcode(t *testing.T) {
+	blob := []byte{
+		VINTR, 0, 0, 0, 3,
+		160, 0xde, 0xad, // undefined opcode with an unknown argument
+		ECHO, 0, 0, 0, 1,
+	}
+	modes, err := DecodeModes(blob)
+	if err != nil {
+		t.Fatalf("DecodeModes: %v", err)
+	}
+	if len(modes) != 1 || modes[0] != (TerminalMode{VINTR, 3}) {
+		t.Errorf("modes = %v, want only VINTR 3", modes)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || ios
+
+package pty
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+func setFlag(flags *tcflag, bit tcflag, on bool) {
+	if on {
+		*flags |= bit
+	} else {
+		*flags &^= bit
+	}
+}
+
+func set_modes(tty *os.File, modes []TerminalMode) error {
+	fd := int(tty.Fd())
+	t, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return err
+	}
+	for _, mode := range modes {
+		on := mode.Value != 0
+		if idx, ok := ccModes[mode.Opcode]; ok {
+			if mode.Value == sshVDisable {
+				t.Cc[idx] = posixVDisable
+			} else {
+				t.Cc[idx] = uint8(mode.Value)
+			}
+		} else if bit, ok := iflagModes[mode.Opcode]; ok {
+			setFlag(&t.Iflag, bit, on)
+		} else if bit, ok := lflagModes[mode.Opcode]; ok {
+			setFlag(&t.Lflag, bit, on)
+		} else if bit, ok := oflagModes[mode.Opcode]; ok {
+			setFlag(&t.Oflag, bit, on)
+		} else {
+			switch mode.Opcode {
+			case CS7:
+				if on {
+					t.Cflag = t.Cflag&^unix.CSIZE | unix.CS7
+				}
+			case CS8:
+				if on {
+					t.Cflag = t.Cflag&^unix.CSIZE | unix.CS8
+				}
+			case PARENB:
+				setFlag(&t.Cflag, unix.PARENB, on)
+			case PARODD:
+				setFlag(&t.Cflag, unix.PARODD, on)
+			case TTY_OP_ISPEED:
+				setSpeed(t, true, mode.Value)
+			case TTY_OP_OSPEED:
+				setSpeed(t, false, mode.Value)
+			}
+		}
+	}
+	return unix.IoctlSetTermios(fd, ioctlSetTermios, t)
+}
@@ -52,20 +52,37 @@ func (pty *Pty) AttachPty(cmd *exec.Cmd) {
 	attach_pty(pty.Tty, cmd)
 }
 
+// Close our handle on the tty, so that reads from the pty end once the
+// processes using it have gone.
+func (pty *Pty) CloseTty() {
+	pty.Tty.Close()
+}
+
 // Close the devices
 func (pty *Pty) Close() {
 	pty.Tty.Close()
 	pty.Pty.Close()
 }
 
-// Resize the pty
+// Resize the pty; the foreground job gets SIGWINCH from the kernel
 func (pty *Pty) Resize(rows, cols, xpix, ypix uint16) error {
 	win := &ptyWindow{rows, cols, xpix, ypix}
 	return resize_pty(pty.Tty, win)
 }
 
-// Attach to IO
-func (pty *Pty) AttachIO(r io.Reader, w io.Writer) {
+// Deliver a break, which for a pty means interrupting the foreground job
+func (pty *Pty) SendBreak() error {
+	return break_pty(pty.Pty)
+}
+
+// Attach to IO.  The returned channel is closed when output copying
+// ends, which is after the tty has been closed everywhere.
+func (pty *Pty) AttachIO(r io.Reader, w io.Writer) <-chan struct{} {
+	done := make(chan struct{})
 	go io.Copy(pty.Pty, r)
-	go io.Copy(w, pty.Pty)
+	go func() {
+		io.Copy(w, pty.Pty)
+		close(done)
+	}()
+	return done
 }
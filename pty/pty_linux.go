@@ -76,7 +76,7 @@ func open_pty() (pty, tty *os.File, err error) {
 }
 
 func resize_pty(tty *os.File, size *ptyWindow) error {
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, tty.Fd(), unix.TIOCGWINSZ, uintptr(unsafe.Pointer(size)))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, tty.Fd(), unix.TIOCSWINSZ, uintptr(unsafe.Pointer(size)))
 	if errno != 0 {
 		return errno
 	}
@@ -89,6 +89,15 @@ func attach_pty(tty *os.File, cmd *exec.Cmd) error {
 	}
 	cmd.SysProcAttr.Setsid = true
 	cmd.SysProcAttr.Setctty = true
-	cmd.SysProcAttr.Ctty = int(tty.Fd())
+	// Ctty is a descriptor number in the child, where the tty is stdin.
+	cmd.SysProcAttr.Ctty = 0
 	return nil
 }
+
+func break_pty(pty *os.File) error {
+	pgrp, err := unix.IoctlGetInt(int(pty.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		return err
+	}
+	return unix.Kill(-pgrp, unix.SIGINT)
+}
@@ -20,6 +20,7 @@ package pty
 
 import (
 	"errors"
+	"golang.org/x/sys/unix"
 	"os"
 	"os/exec"
 	"syscall"
@@ -37,6 +38,19 @@ func attach_pty(tty *os.File, cmd *exec.Cmd) error {
 	return nil
 }
 
-func resize_pty(_ *os.File, _ *ptyWindow) error {
-	return Unsupported
+func break_pty(pty *os.File) error {
+	pgrp, err := unix.IoctlGetInt(int(pty.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		return err
+	}
+	return unix.Kill(-pgrp, unix.SIGINT)
+}
+
+func resize_pty(tty *os.File, size *ptyWindow) error {
+	return unix.IoctlSetWinsize(int(tty.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Row:    size.rows,
+		Col:    size.cols,
+		Xpixel: size.xpix,
+		Ypixel: size.ypix,
+	})
 }
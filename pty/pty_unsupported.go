@@ -36,3 +36,11 @@ func attach_pty(_ *os.File, _ *exec.Cmd) error {
 func resize_pty(_ *os.File, _ *ptyWindow) error {
 	return Unsupported
 }
+
+func break_pty(_ *os.File) error {
+	return Unsupported
+}
+
+func set_modes(_ *os.File, _ []TerminalMode) error {
+	return Unsupported
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Recording of pty sessions as asciicast v2 files, one per session in
+// record_dir.  See https://docs.asciinema.org/manual/asciicast/v2/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// First line of a cast file.  User, KeyFingerprint and Client are ours;
+// players ignore fields they don't know.
+type castHeader struct {
+	Version        int               `json:"version"`
+	Width          uint32            `json:"width"`
+	Height         uint32            `json:"height"`
+	Timestamp      int64             `json:"timestamp"`
+	Command        string            `json:"command,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	User           string            `json:"user,omitempty"`
+	KeyFingerprint string            `json:"key_fingerprint,omitempty"`
+	Client         string            `json:"client,omitempty"`
+}
+
+// Writes the events of one session to a cast file
+type castRecorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	start  time.Time
+	failed bool
+}
+
+func newCastRecorder(dir, user string, header *castHeader) (*castRecorder, error) {
+	// Keep the user name from leaving the directory or confusing globs.
+	safeUser := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '*' || r == '.' {
+			return '_'
+		}
+		return r
+	}, user)
+	start := time.Now()
+	f, err := ioutil.TempFile(dir, start.Format("20060102-150405")+"-"+safeUser+"-*.cast")
+	if err != nil {
+		return nil, err
+	}
+	header.Version = 2
+	header.Timestamp = start.Unix()
+	line, _ := json.Marshal(header)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	dbg.Debug("Recording session to %s", f.Name())
+	return &castRecorder{f: f, start: start}, nil
+}
+
+// Append an event.  Recording trouble never interrupts the session.
+func (r *castRecorder) event(code, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil || r.failed {
+		return
+	}
+	elapsed := time.Since(r.start).Seconds()
+	line, _ := json.Marshal([]interface{}{elapsed, code, data})
+	if _, err := r.f.Write(append(line, '\n')); err != nil {
+		dbg.Debug("Error writing recording, giving up: %v", err)
+		r.failed = true
+	}
+}
+
+func (r *castRecorder) resize(cols, rows uint32) {
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *castRecorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// An io.Writer recording what passes through as "o" or "i" events.  A
+// multi-byte character split between writes is held back until it's
+// complete, since events must be valid UTF-8.
+type castStream struct {
+	r       *castRecorder
+	code    string
+	partial []byte
+}
+
+func (s *castStream) Write(p []byte) (int, error) {
+	data := append(s.partial, p...)
+	end := len(data)
+	// Back up over at most one incomplete trailing character.
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if c := data[len(data)-i]; utf8.RuneStart(c) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				end = len(data) - i
+			}
+			break
+		}
+	}
+	if end > 0 {
+		s.r.event(s.code, string(data[:end]))
+	}
+	s.partial = append([]byte{}, data[end:]...)
+	return len(p), nil
+}
+
+// Should this connection's pty sessions be recorded?  The key decides,
+// then the user, and otherwise everything is when record_dir is set.
+func (conn *ServerConn) shouldRecord() bool {
+	if conn.RecordDir == "" {
+		return false
+	}
+	if conn.opts.Record != nil {
+		return *conn.opts.Record
+	}
+	if conn.user != nil && conn.user.Record != nil {
+		return *conn.user.Record
+	}
+	return true
+}
+
+// Start recording the session, if it should be
+func (conn *ServerConn) startRecording(sess *session, command string) {
+	if !conn.shouldRecord() {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	header := &castHeader{
+		Width:   sess.cols,
+		Height:  sess.rows,
+		Command: command,
+		Env: map[string]string{
+			"TERM":  sess.term,
+			"SHELL": conn.shellExe(),
+		},
+		User:           conn.loginName(),
+		KeyFingerprint: conn.keyFingerprint(),
+		Client:         conn.RemoteAddr().String(),
+	}
+	rec, err := newCastRecorder(conn.RecordDir, conn.loginName(), header)
+	if err != nil {
+		dbg.Debug("Unable to record session: %v", err)
+		return
+	}
+	sess.recorder = rec
+	sess.recordInput = conn.RecordInput
+}
@@ -28,6 +28,8 @@ import (
 	"strings"
 )
 
+var scpLog = dbg.Subsystem("scp")
+
 const (
 	SCPCopy = iota
 	SCPDir
@@ -77,7 +79,7 @@ func (conn *ServerConn) SCPHandler(shellCmd []string, ch ssh.Channel) error {
 		case "-p":
 		case "-v":
 		default:
-			dbg.Debug("scp path: %s", opt)
+			scpLog.Debug("scp path: %s", opt)
 			path = opt
 		}
 	}
@@ -102,13 +104,13 @@ func (conn *ServerConn) SCPSource(path string, dirMode bool, recursive bool, ch
 		return err
 	}
 	if recursive {
-		return SCPSendDir(path, nil, src, ch)
+		return conn.SCPSendDir(path, nil, src, ch)
 	}
-	return SCPSendFile(path, src, ch)
+	return conn.SCPSendFile(path, src, ch)
 }
 
 // Send a directory
-func SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) error {
+func (conn *ServerConn) SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) error {
 	if fi == nil {
 		if statfi, err := os.Stat(path); err != nil {
 			return err
@@ -117,12 +119,12 @@ func SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) e
 		}
 	}
 
-	dbg.Debug("Preparing to send dir: %s", path)
+	scpLog.Debug("Preparing to send dir: %s", path)
 	cmd := buildSCPCommand(fi)
 	if _, err := dst.Write([]byte(cmd)); err != nil {
 		return err
 	}
-	dbg.Debug("sent header")
+	scpLog.Trace("sent header")
 	if err := readAck(src); err != nil {
 		return err
 	}
@@ -135,9 +137,9 @@ func SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) e
 		for _, child := range contents {
 			lpath := filepath.Join(path, child.Name())
 			if child.IsDir() {
-				SCPSendDir(lpath, child, src, dst)
+				conn.SCPSendDir(lpath, child, src, dst)
 			} else {
-				SCPSendFile2(lpath, child, src, dst)
+				conn.SCPSendFile2(lpath, child, src, dst)
 			}
 		}
 	}
@@ -148,22 +150,23 @@ func SCPSendDir(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) e
 	if err := readAck(src); err != nil {
 		return err
 	}
-	dbg.Debug("Done sending dir: %s", path)
+	scpLog.Debug("Done sending dir: %s", path)
 	return nil
 }
 
 // Send a file
-func SCPSendFile(path string, src *bufio.Reader, dst io.Writer) error {
-	dbg.Debug("Preparing to send %s", path)
+func (conn *ServerConn) SCPSendFile(path string, src *bufio.Reader, dst io.Writer) error {
+	scpLog.Debug("Preparing to send %s", path)
 	fi, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	return SCPSendFile2(path, fi, src, dst)
+	return conn.SCPSendFile2(path, fi, src, dst)
 }
 
 // Actually send the file
-func SCPSendFile2(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) error {
+func (conn *ServerConn) SCPSendFile2(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer) (err error) {
+	defer func() { conn.auditSCP("download", path, fi.Size(), err) }()
 	if fi.Mode()&os.ModeType != 0 {
 		scpSendAck(dst, SCPFatal, ErrNotRegularFile.Error())
 		return ErrNotRegularFile
@@ -178,24 +181,33 @@ func SCPSendFile2(path string, fi os.FileInfo, src *bufio.Reader, dst io.Writer)
 	if _, err := dst.Write([]byte(cmd)); err != nil {
 		return err
 	}
-	dbg.Debug("sent header")
+	scpLog.Trace("sent header")
 	if err := readAck(src); err != nil {
 		return err
 	}
-	dbg.Debug("sending data...")
+	scpLog.Trace("sending data...")
 	if _, err := io.Copy(dst, fp); err != nil {
 		scpSendAck(dst, SCPFatal, err.Error())
 		return err
 	}
-	dbg.Debug("data sent")
+	scpLog.Trace("data sent")
 	scpSendAck(dst, SCPOK, "")
 	if err := readAck(src); err != nil {
 		return err
 	}
-	dbg.Debug("successfully sent file")
+	scpLog.Trace("successfully sent file")
 	return nil
 }
 
+// Record a file transfer in the audit log
+func (conn *ServerConn) auditSCP(direction, path string, size int64, err error) {
+	conn.auditResult("scp", auditFields{
+		"direction": direction,
+		"path":      path,
+		"bytes":     size,
+	}, err)
+}
+
 func buildSCPCommand(fi os.FileInfo) string {
 	c := 'C'
 	if fi.IsDir() {
@@ -203,7 +215,7 @@ func buildSCPCommand(fi os.FileInfo) string {
 	}
 	ret := fmt.Sprintf("%c%04o %d %s\n",
 		c, fi.Mode()&os.ModePerm, fi.Size(), fi.Name())
-	dbg.Debug("cmd: %s", strings.TrimSpace(ret))
+	scpLog.Debug("cmd: %s", strings.TrimSpace(ret))
 	return ret
 }
 
@@ -212,7 +224,7 @@ func readAck(src *bufio.Reader) error {
 	if ack, ackMsg, err := readAckDetails(src); err != nil {
 		return err
 	} else if ack != SCPOK {
-		dbg.Debug("SCP Ack error %d, msg \"%s\"", ack, ackMsg)
+		scpLog.Debug("SCP Ack error %d, msg \"%s\"", ack, ackMsg)
 		return fmt.Errorf("SCP Error %d", ack)
 	}
 	return nil
@@ -248,33 +260,35 @@ func (conn *ServerConn) SCPSink(path string, dirMode bool, ch ssh.Channel) error
 		if err != nil {
 			if err == io.EOF {
 				// EOF here isn't bad
-				dbg.Debug("eof in scp sink")
+				scpLog.Debug("eof in scp sink")
 				scpSendAck(ch, 0, "")
 				return nil
 			}
 			scpSendAck(ch, 2, err.Error())
-			dbg.Debug("error in scp sink: %v", err)
+			scpLog.Debug("error in scp sink: %v", err)
 			return err
 		}
 		if cmd == SCP_END_COMMANDS {
-			dbg.Debug("continue scp")
+			scpLog.Trace("continue scp")
 			continue
 		}
 		// Parse it
 		parsed, err := parseSCPCommand(cmd)
 		if err != nil {
 			scpSendAck(ch, 2, err.Error())
-			dbg.Debug("error in scp sink: %v", err)
+			scpLog.Debug("error in scp sink: %v", err)
 			return err
 		}
-		dbg.Debug("scp command: %v", parsed)
+		scpLog.Debug("scp command: %v", parsed)
 		switch parsed.CommandType {
 		case SCPCopy:
 			if err := scpSendAck(ch, 0, ""); err != nil {
 				return err
 			}
 			fpath := filepath.Join(path, parsed.Name)
-			if err := receiveFile(fpath, parsed, readbuf); err != nil {
+			err := receiveFile(fpath, parsed, readbuf)
+			conn.auditSCP("upload", fpath, parsed.Length, err)
+			if err != nil {
 				scpSendAck(ch, 2, err.Error())
 				return err
 			}
@@ -16,34 +16,67 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto/subtle"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"text/template"
+	"time"
 )
 
 // Manage the SSH Server
 type Server struct {
-	ServerConfig   ssh.ServerConfig
-	Socket         net.Listener
-	AuthorizedKeys map[string]bool
-	AuthPassword   string
-	stop           chan bool
-	done           chan bool
+	ServerConfig      ssh.ServerConfig
+	Socket            net.Listener
+	AuthorizedKeys    map[string]*keyOptions
+	UserCAKeys        map[string]*keyOptions
+	RevokedSerials    map[uint64]bool
+	Users             map[string]*userAccount
+	BaseEnv           []string
+	AcceptEnv         []string
+	DenyEnv           []string
+	HangupGrace       time.Duration
+	NoAgentForwarding bool
+	NoX11Forwarding   bool
+	RecordDir         string
+	RecordInput       bool
+	authFailures      *authTracker
+	sessions          sessionSet
+	auditLog          *auditLog
+	handshakes        handshakeSet
+	motd              *template.Template
+	lastLogins        lastLog
+	started           time.Time
+	hostSigners       []ssh.Signer
+	AuthPassword      string
+	stop              chan bool
+	stopOnce          sync.Once
+	done              chan bool
 }
 
 var keyNames = []string{
 	"ssh_host_dsa_key",
 	"ssh_host_ecdsa_key",
+	"ssh_host_ed25519_key",
 	"ssh_host_rsa_key",
 }
 
 func NewServer() *Server {
 	s := &Server{}
-	s.AuthorizedKeys = make(map[string]bool)
+	s.AuthorizedKeys = make(map[string]*keyOptions)
+	s.UserCAKeys = make(map[string]*keyOptions)
+	s.RevokedSerials = make(map[uint64]bool)
+	s.Users = make(map[string]*userAccount)
+	s.BaseEnv = defaultBaseEnv()
+	s.AcceptEnv = defaultAcceptEnv
+	s.DenyEnv = defaultDenyEnv
+	s.HangupGrace = defaultHangupGrace
+	s.started = time.Now()
+	s.authFailures = newAuthTracker()
+	s.ServerConfig.AuthLogCallback = s.logAuthAttempt
 	s.stop = make(chan bool)
 	s.done = make(chan bool, 1)
 	s.ServerConfig.NoClientAuth = true
@@ -53,10 +86,10 @@ func NewServer() *Server {
 func (s *Server) listen(port int16) error {
 	sPort := ":" + strconv.Itoa(int(port))
 	if sock, err := net.Listen("tcp", sPort); err != nil {
-		dbg.Debug("Unable to listen: %v", err)
+		dbg.Error("Unable to listen: %v", err)
 		return err
 	} else {
-		dbg.Debug("Listening on %s", sPort)
+		dbg.Info("Listening on %s", sPort)
 		s.Socket = sock
 	}
 	return nil
@@ -69,10 +102,15 @@ func (s *Server) acceptChannel() <-chan net.Conn {
 		for {
 			conn, err := s.Socket.Accept()
 			if err != nil {
-				dbg.Debug("Unable to accept: %v", err)
+				dbg.Warn("Unable to accept: %v", err)
 				return
 			}
-			dbg.Debug("Accepted connection from: %s", conn.RemoteAddr())
+			if s.authFailures.banned(addrIP(conn.RemoteAddr())) {
+				dbg.Info("Dropping connection from banned address: %s", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			dbg.Info("Accepted connection from: %s", conn.RemoteAddr())
 			c <- conn
 		}
 	}()
@@ -80,16 +118,26 @@ func (s *Server) acceptChannel() <-chan net.Conn {
 }
 
 func (s *Server) handleConn(conn net.Conn) {
-	sConn, err := NewServerConn(conn, s)
+	id := newConnID()
+	began := time.Now()
+	remote := conn.RemoteAddr().String()
+	s.audit(id, "connect", auditFields{"remote": remote, "local": conn.LocalAddr().String()})
+	s.handshakes.add(remote, id)
+	sConn, err := NewServerConn(conn, s, id)
+	s.handshakes.remove(remote)
 	if err != nil {
+		s.audit(id, "disconnect", auditFields{
+			"error":    err.Error(),
+			"duration": time.Since(began).Seconds(),
+		})
 		if err == io.EOF {
 			dbg.Debug("Connection closed by remote host.")
 			return
 		}
-		dbg.Debug("Unable to negotiate SSH: %v", err)
+		dbg.Info("Unable to negotiate SSH: %v", err)
 		return
 	}
-	dbg.Debug("Authenticated client from: %s", sConn.RemoteAddr())
+	dbg.Info("Authenticated client from: %s", sConn.RemoteAddr())
 
 	go sConn.HandleConn()
 }
@@ -97,12 +145,13 @@ func (s *Server) handleConn(conn net.Conn) {
 func (s *Server) serveLoop() error {
 	acceptChan := s.acceptChannel()
 	defer func() {
-		dbg.Debug("done serveLoop")
+		dbg.Trace("done serveLoop")
 		s.Socket.Close()
+		s.sessions.hangupAll(s.HangupGrace)
 		s.done <- true
 	}()
 	for {
-		dbg.Debug("select...")
+		dbg.Trace("select...")
 		select {
 		case conn, ok := <-acceptChan:
 			if ok {
@@ -113,7 +162,7 @@ func (s *Server) serveLoop() error {
 				return nil
 			}
 		case <-s.stop:
-			dbg.Debug("Stop signal received, stopping.")
+			dbg.Info("Stop signal received, stopping.")
 			return nil
 		}
 	}
@@ -144,9 +193,11 @@ func (s *Server) Wait() {
 
 // Ask for shutdown
 func (s *Server) Stop() {
-	dbg.Debug("requesting shutdown.")
-	s.stop <- true
-	close(s.stop)
+	s.stopOnce.Do(func() {
+		dbg.Debug("requesting shutdown.")
+		s.stop <- true
+		close(s.stop)
+	})
 }
 
 func (s *Server) AddAuthorizedKeys(keyData []byte) {
@@ -154,16 +205,35 @@ func (s *Server) AddAuthorizedKeys(keyData []byte) {
 		s.ServerConfig.PublicKeyCallback = s.VerifyPublicKey
 		s.ServerConfig.NoClientAuth = false
 	}
-	for len(keyData) > 0 {
-		newKey, _, _, left, err := ssh.ParseAuthorizedKey(keyData)
-		keyData = left
-		if err != nil {
-			dbg.Debug("Error parsing key: %v", err)
-			break
-		}
-		s.AuthorizedKeys[string(newKey.Marshal())] = true
+	keys, caKeys := parseAuthorizedKeys(keyData)
+	for keyStr, opts := range keys {
+		s.AuthorizedKeys[keyStr] = opts
 	}
+	for keyStr, opts := range caKeys {
+		dbg.Debug("Adding cert-authority key.")
+		s.addUserCAKey(keyStr, opts)
+	}
+}
+
+// Ban addresses with threshold failures within window for duration
+func (s *Server) SetBanPolicy(threshold int, window, duration time.Duration) {
+	s.authFailures.Lock()
+	defer s.authFailures.Unlock()
+	s.authFailures.Threshold = threshold
+	s.authFailures.Window = window
+	s.authFailures.Duration = duration
 }
+
+// Time a hung up command gets between SIGHUP and SIGKILL
+func (s *Server) SetHangupGrace(grace time.Duration) {
+	s.HangupGrace = grace
+}
+
+// Limit authentication attempts per connection
+func (s *Server) SetMaxAuthTries(tries int) {
+	s.ServerConfig.MaxAuthTries = tries
+}
+
 func (s *Server) SetAuthPassword(password []byte) {
 	if password != nil && len(password) > 0 {
 		s.AuthPassword = string(password)
@@ -172,18 +242,79 @@ func (s *Server) SetAuthPassword(password []byte) {
 	}
 }
 
+// Extension carrying the SHA256 fingerprint of the key used to log in
+const permKeyFingerprint = "key-fingerprint"
+
 func (s *Server) VerifyPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fingerprint := keyFingerprint(key)
+	s.handshakes.offerKey(conn.RemoteAddr().String(), fingerprint)
+	perms, err := s.verifyPublicKey(conn, key)
+	if err != nil {
+		return nil, err
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = make(map[string]string)
+	}
+	perms.Extensions[permKeyFingerprint] = fingerprint
+	return perms, nil
+}
+
+// SHA256 fingerprint of a key, or of the key inside a certificate
+func keyFingerprint(key ssh.PublicKey) string {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+func (s *Server) verifyPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	account := s.Users[conn.User()]
+	if cert, ok := key.(*ssh.Certificate); ok {
+		perms, err := s.verifyCertificate(conn, cert, account)
+		if err != nil {
+			dbg.Debug("Certificate refused: %v", err)
+			return nil, err
+		}
+		if account != nil {
+			perms = account.addToPermissions(perms)
+		}
+		return perms, nil
+	}
+	// Configured users may only use their own keys.
+	authorizedKeys := s.AuthorizedKeys
+	if account != nil {
+		authorizedKeys = account.AuthorizedKeys
+	}
 	keyStr := string(key.Marshal())
-	if _, ok := s.AuthorizedKeys[keyStr]; !ok {
+	opts, ok := authorizedKeys[keyStr]
+	if !ok {
 		dbg.Debug("Key not found!")
 		return nil, fmt.Errorf("No valid key found.")
 	}
-	return &ssh.Permissions{}, nil
+	if err := opts.checkLogin(conn.RemoteAddr(), time.Now()); err != nil {
+		dbg.Debug("Key refused: %v", err)
+		return nil, err
+	}
+	if account != nil {
+		return account.addToPermissions(opts.permissions()), nil
+	}
+	return opts.permissions(), nil
 }
 
 func (s *Server) VerifyPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	passwordStr := string(password)
-	if s.AuthPassword != "" && s.AuthPassword != passwordStr {
+	if account, ok := s.Users[conn.User()]; ok {
+		if !account.checkPassword(password) {
+			dbg.Debug("Password incorrect for %s!", conn.User())
+			return nil, fmt.Errorf("Password incorrect.")
+		}
+		return account.addToPermissions(nil), nil
+	}
+	if s.AuthPassword == "" {
+		checkPasswordHash(dummyPasswordHash, password)
+		dbg.Debug("Unknown user %s!", conn.User())
+		return nil, fmt.Errorf("Password incorrect.")
+	}
+	if subtle.ConstantTimeCompare([]byte(s.AuthPassword), password) != 1 {
 		dbg.Debug("Password incorrect!")
 		return nil, fmt.Errorf("Password incorrect.")
 	}
@@ -193,21 +324,8 @@ func (s *Server) VerifyPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Pe
 func (s *Server) AddHostkey(keyData []byte) error {
 	key, err := ssh.ParsePrivateKey(keyData)
 	if err == nil {
-		s.ServerConfig.AddHostKey(key)
+		s.addHostSigner(key)
 		return nil
 	}
 	return err
 }
-
-func (s *Server) RandomHostkey() error {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
-	}
-	signer, err := ssh.NewSignerFromSigner(key)
-	if err != nil {
-		return err
-	}
-	s.ServerConfig.AddHostKey(signer)
-	return nil
-}
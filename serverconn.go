@@ -16,9 +16,7 @@
 package main
 
 import (
-	"fmt"
 	exec2 "github.com/Matir/sshdog/exec"
-	"github.com/Matir/sshdog/pty"
 	"github.com/google/shlex"
 	"golang.org/x/crypto/ssh"
 	"io"
@@ -26,41 +24,69 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 )
 
 // Handling for a single incoming connection
 type ServerConn struct {
 	*Server
 	*ssh.ServerConn
-	pty        *pty.Pty
-	reqs       <-chan *ssh.Request
-	chans      <-chan ssh.NewChannel
-	environ    []string
-	exitStatus uint32
+	reqs         <-chan *ssh.Request
+	chans        <-chan ssh.NewChannel
+	forwards     remoteForwards
+	opts         *keyOptions
+	user         *userAccount
+	account      *user.User
+	id           string // for the audit log
+	since        time.Time
+	sessionCount int32 // session channels opened so far
 }
 
-func NewServerConn(conn net.Conn, s *Server) (*ServerConn, error) {
+func NewServerConn(conn net.Conn, s *Server, id string) (*ServerConn, error) {
 	sConn, chans, reqs, err := ssh.NewServerConn(conn, &s.ServerConfig)
 	if err != nil {
 		return nil, err
 	}
-	return &ServerConn{
+	sc := &ServerConn{
 		Server:     s,
 		ServerConn: sConn,
 		reqs:       reqs,
 		chans:      chans,
-		environ:    os.Environ(),
-	}, nil
+		opts:       keyOptionsFromPermissions(sConn.Permissions),
+		user:       s.userFromPermissions(sConn.Permissions),
+		id:         id,
+		since:      time.Now(),
+	}
+	name := sConn.User()
+	if sc.user != nil {
+		name = sc.user.Name
+	}
+	sc.account = systemAccount(name)
+	return sc, nil
 }
 
 func (conn *ServerConn) ServiceGlobalRequests() {
 	for r := range conn.reqs {
 		dbg.Debug("Received request %s plus %d bytes.", r.Type, len(r.Payload))
-		if r.WantReply {
-			r.Reply(true, []byte{})
+		switch r.Type {
+		case "tcpip-forward":
+			conn.handleTCPIPForward(r)
+		case "cancel-tcpip-forward":
+			conn.handleCancelTCPIPForward(r)
+		case "streamlocal-forward@openssh.com":
+			conn.handleStreamLocalForward(r)
+		case "cancel-streamlocal-forward@openssh.com":
+			conn.handleCancelStreamLocalForward(r)
+		default:
+			if r.WantReply {
+				r.Reply(false, []byte{})
+			}
 		}
 	}
 }
@@ -70,6 +96,7 @@ func (conn *ServerConn) HandleConn() {
 	defer func() {
 		dbg.Debug("Closing connection to: %s", conn.RemoteAddr())
 		conn.Close()
+		conn.audit("disconnect", auditFields{"duration": time.Since(conn.since).Seconds()})
 	}()
 
 	go conn.ServiceGlobalRequests()
@@ -84,12 +111,17 @@ func (conn *ServerConn) HandleConn() {
 		case "direct-tcpip":
 			wg.Add(1)
 			go conn.HandleTCPIPChannel(wg, newChan)
+		case "direct-streamlocal@openssh.com":
+			wg.Add(1)
+			go conn.HandleStreamLocalChannel(wg, newChan)
 		default:
 			dbg.Debug("Unable to handle channel request, rejecting.")
 			newChan.Reject(ssh.Prohibited, "Prohibited")
 		}
 	}
 
+	// The connection is gone; stop listening on its behalf right away.
+	conn.forwards.closeAll()
 	wg.Wait()
 }
 
@@ -111,12 +143,33 @@ type ExecRequest struct {
 	Cmd string
 }
 
-func shellExe() string {
+type SubsystemRequest struct {
+	Name string
+}
+
+type WindowChangeRequest struct {
+	Width    uint32
+	Height   uint32
+	WidthPx  uint32
+	HeightPx uint32
+}
+
+type SignalRequest struct {
+	Signal string
+}
+
+// Shell from SSHDOG_SHELL, the account's login shell, or the default
+func shellExe(account *user.User) string {
 	if shell := os.Getenv("SSHDOG_SHELL"); shell != "" {
 		if _, err := os.Stat(shell); err == nil {
 			return shell
 		}
 	}
+	if account != nil {
+		if shell := passwdShell(account.Username); shell != "" {
+			return shell
+		}
+	}
 	switch runtime.GOOS {
 	case "windows":
 		return "C:\\windows\\system32\\cmd.exe"
@@ -125,29 +178,69 @@ func shellExe() string {
 	}
 }
 
-func defaultShell() []string {
+// Shell configured for the logged in user, or the system default
+func (conn *ServerConn) shellExe() string {
+	if conn.user != nil && conn.user.Shell != "" {
+		return conn.user.Shell
+	}
+	return shellExe(conn.account)
+}
+
+// Name of the logged in account: the configured user, or the system
+// account we run the session as
+func (conn *ServerConn) loginName() string {
+	if conn.user != nil {
+		return conn.user.Name
+	}
+	if conn.account != nil {
+		return conn.account.Username
+	}
+	return conn.User()
+}
+
+// Fingerprint of the key the client logged in with, or ""
+func (conn *ServerConn) keyFingerprint() string {
+	if conn.Permissions == nil {
+		return ""
+	}
+	return conn.Permissions.Extensions[permKeyFingerprint]
+}
+
+// Home directory configured for the logged in user, or the system
+// account's, or "" if unknown
+func (conn *ServerConn) homeDir() string {
+	if conn.user != nil && conn.user.Home != "" {
+		return conn.user.Home
+	}
+	if conn.account != nil {
+		return conn.account.HomeDir
+	}
+	return ""
+}
+
+func defaultShell(shell string) []string {
 	switch runtime.GOOS {
 	case "windows":
 		return []string{
-			shellExe(),
+			shell,
 			"/Q",
 		}
 	default:
-		return []string{shellExe()}
+		return []string{shell}
 	}
 }
 
-func commandWithShell(command string) []string {
+func commandWithShell(shell, command string) []string {
 	switch runtime.GOOS {
 	case "windows":
 		return []string{
-			shellExe(),
+			shell,
 			"/C",
 			command,
 		}
 	default:
 		return []string{
-			shellExe(),
+			shell,
 			"-c",
 			command,
 		}
@@ -162,83 +255,266 @@ func (conn *ServerConn) HandleSessionChannel(wg *sync.WaitGroup, newChan ssh.New
 		dbg.Debug("Unable to accept newChan: %v", err)
 		return
 	}
-	defer func() {
-		b := ssh.Marshal(struct{ ExitStatus uint32 }{conn.exitStatus})
-		ch.SendRequest("exit-status", false, b)
-		dbg.Debug("Closing session channel.")
-		ch.Close()
-	}()
+	sess := newSession(ch)
+	conn.sessions.add(sess)
+	defer conn.sessions.remove(sess)
+	defer sess.close()
+
+	// The command runs in the background so that requests such as
+	// "signal" can still be serviced while it does.
+	done := make(chan struct{})
+	started := false
+	sessionID := atomic.AddInt32(&conn.sessionCount, 1)
+	start := func(kind, command string, run func() exitStatus) {
+		started = true
+		conn.audit("session_start", auditFields{
+			"session": sessionID,
+			"type":    kind,
+			"command": command,
+			"pty":     sess.pty != nil,
+		})
+		go func() {
+			began := time.Now()
+			sess.status = run()
+			conn.audit("session_end", auditFields{
+				"session":     sessionID,
+				"exit_status": sess.status.Status,
+				"signal":      sess.status.Signal,
+				"duration":    time.Since(began).Seconds(),
+			})
+			close(done)
+		}()
+	}
 
 	var success bool
-	for req := range reqs {
+	for {
+		var req *ssh.Request
+		var ok bool
+		select {
+		case <-done:
+			return
+		case req, ok = <-reqs:
+		}
+		if !ok {
+			if !started {
+				return
+			}
+			// The client closed the channel or went away; don't leave
+			// the command running on its own.
+			sess.hangup(conn.HangupGrace)
+			reqs = nil
+			continue
+		}
 		switch req.Type {
 		case "pty-req":
+			if conn.opts.NoPty || started {
+				dbg.Debug("pty-req refused.")
+				if req.WantReply {
+					req.Reply(false, []byte{})
+				}
+				continue
+			}
 			ptyreq := &PTYRequest{}
-			success = true
+			success = false
 			if err := ssh.Unmarshal(req.Payload, ptyreq); err != nil {
 				dbg.Debug("Error unmarshaling pty-req: %v", err)
-				success = false
-			}
-			conn.pty, err = pty.OpenPty()
-			if conn.pty != nil {
-				conn.pty.Resize(uint16(ptyreq.Height), uint16(ptyreq.Width), uint16(ptyreq.WidthPx), uint16(ptyreq.HeightPx))
-				os.Setenv("TERM", ptyreq.Term)
-				// TODO: set pty modes
-			}
-			if err != nil {
+			} else if err := sess.openPty(ptyreq); err != nil {
 				dbg.Debug("Failed allocating pty: %v", err)
-				success = false
+			} else {
+				success = true
 			}
 			if req.WantReply {
 				req.Reply(success, []byte{})
 			}
 		case "env":
 			envreq := &EnvRequest{}
-			if err := ssh.Unmarshal(req.Payload, envreq); err != nil {
+			if started {
+				// The command already has its environment, and may still
+				// be reading sess.env.
+				dbg.Debug("Session already running, refusing env.")
+				success = false
+			} else if err := ssh.Unmarshal(req.Payload, envreq); err != nil {
 				dbg.Debug("Error unmarshaling env: %v", err)
 				success = false
+			} else if !conn.acceptsEnv(envreq.Name) {
+				dbg.Debug("env: refusing %s", envreq.Name)
+				success = false
 			} else {
 				dbg.Debug("env: %s=%s", envreq.Name, envreq.Value)
-				conn.environ = append(conn.environ, fmt.Sprintf("%s=%s", envreq.Name, envreq.Value))
+				sess.env = mergeEnv(sess.env, envreq.Name+"="+envreq.Value)
 				success = true
 			}
 			if req.WantReply {
 				req.Reply(success, []byte{})
 			}
 		case "shell":
-			// TODO: get the user's shell
-			conn.ExecuteForChannel(defaultShell(), ch)
+			if started {
+				dbg.Debug("Session already running, refusing shell.")
+				if req.WantReply {
+					req.Reply(false, []byte{})
+				}
+				continue
+			}
 			if req.WantReply {
 				req.Reply(true, []byte{})
 			}
-			return
+			if conn.opts.Command != "" {
+				start("shell", conn.opts.Command, func() exitStatus { return conn.runForcedCommand("", sess) })
+				continue
+			}
+			conn.writeMotd(sess)
+			sess.loginShell = true
+			start("shell", conn.shellExe(), func() exitStatus { return conn.ExecuteForChannel(defaultShell(conn.shellExe()), sess) })
 		case "exec":
+			if started {
+				dbg.Debug("Session already running, refusing exec.")
+				if req.WantReply {
+					req.Reply(false, []byte{})
+				}
+				continue
+			}
 			execReq := &ExecRequest{}
 			if err := ssh.Unmarshal(req.Payload, execReq); err != nil {
 				dbg.Debug("Error unmarshaling exec: %v", err)
-				success = false
-			} else {
-				if cmd, err := shlex.Split(execReq.Cmd); err == nil {
-					dbg.Debug("Command: %v", cmd)
-					if req.WantReply {
-						req.Reply(true, []byte{})
-					}
-					if cmd[0] == "scp" {
-						if err := conn.SCPHandler(cmd, ch); err != nil {
-							dbg.Debug("scp failure: %v", err)
-							conn.exitStatus = 1
-						}
+				if req.WantReply {
+					req.Reply(false, []byte{})
+				}
+				return
+			}
+			if conn.opts.Command != "" {
+				if req.WantReply {
+					req.Reply(true, []byte{})
+				}
+				start("exec", conn.opts.Command, func() exitStatus { return conn.runForcedCommand(execReq.Cmd, sess) })
+				continue
+			}
+			cmd, err := shlex.Split(execReq.Cmd)
+			if err != nil || len(cmd) == 0 {
+				dbg.Debug("Error splitting cmd: %v", err)
+				if req.WantReply {
+					req.Reply(false, []byte{})
+				}
+				return
+			}
+			dbg.Debug("Command: %v", cmd)
+			if req.WantReply {
+				req.Reply(true, []byte{})
+			}
+			if cmd[0] == "scp" {
+				start("exec", execReq.Cmd, func() exitStatus {
+					var err error
+					if switchesUser(conn.account) {
+						err = conn.runFileHelper(ch, cmd...)
 					} else {
-						conn.ExecuteForChannel(commandWithShell(execReq.Cmd), ch)
+						err = conn.SCPHandler(cmd, ch)
 					}
-				} else {
-					dbg.Debug("Error splitting cmd: %v", err)
-					if req.WantReply {
-						req.Reply(false, []byte{})
+					if err != nil {
+						dbg.Debug("scp failure: %v", err)
+						return exitStatus{Status: 1}
 					}
+					return exitStatus{}
+				})
+			} else {
+				start("exec", execReq.Cmd, func() exitStatus {
+					return conn.ExecuteForChannel(commandWithShell(conn.shellExe(), execReq.Cmd), sess)
+				})
+			}
+		case "subsystem":
+			subReq := &SubsystemRequest{}
+			if err := ssh.Unmarshal(req.Payload, subReq); err != nil {
+				dbg.Debug("Error unmarshaling subsystem: %v", err)
+				if req.WantReply {
+					req.Reply(false, []byte{})
 				}
+				continue
+			}
+			dbg.Debug("Subsystem: %s", subReq.Name)
+			if started || (conn.opts.Command == "" && subReq.Name != "sftp") {
+				if req.WantReply {
+					req.Reply(false, []byte{})
+				}
+				continue
+			}
+			if req.WantReply {
+				req.Reply(true, []byte{})
+			}
+			if conn.opts.Command != "" {
+				start("subsystem", conn.opts.Command, func() exitStatus { return conn.runForcedCommand(subReq.Name, sess) })
+				continue
+			}
+			start("subsystem", subReq.Name, func() exitStatus {
+				var err error
+				if switchesUser(conn.account) {
+					err = conn.runFileHelper(ch, "sftp")
+				} else {
+					err = conn.SFTPHandler(ch)
+				}
+				if err != nil {
+					dbg.Debug("sftp failure: %v", err)
+					return exitStatus{Status: 1}
+				}
+				return exitStatus{}
+			})
+		case "auth-agent-req@openssh.com":
+			success = false
+			if !conn.permitsAgentForwarding() || started {
+				dbg.Debug("Agent forwarding refused.")
+			} else if err := conn.startAgentForwarding(sess); err != nil {
+				dbg.Debug("Unable to forward agent: %v", err)
+			} else {
+				success = true
+			}
+			if req.WantReply {
+				req.Reply(success, []byte{})
+			}
+		case "x11-req":
+			x11Req := &x11Request{}
+			success = false
+			if !conn.permitsX11Forwarding() || started {
+				dbg.Debug("X11 forwarding refused.")
+			} else if err := ssh.Unmarshal(req.Payload, x11Req); err != nil {
+				dbg.Debug("Error unmarshaling x11-req: %v", err)
+			} else if err := conn.startX11Forwarding(sess, x11Req); err != nil {
+				dbg.Debug("Unable to forward X11: %v", err)
+			} else {
+				success = true
+			}
+			if req.WantReply {
+				req.Reply(success, []byte{})
+			}
+		case "window-change":
+			winReq := &WindowChangeRequest{}
+			success = false
+			if err := ssh.Unmarshal(req.Payload, winReq); err != nil {
+				dbg.Debug("Error unmarshaling window-change: %v", err)
+			} else if err := sess.resize(winReq); err != nil {
+				dbg.Debug("Unable to resize pty: %v", err)
+			} else {
+				success = true
+			}
+			if req.WantReply {
+				req.Reply(success, []byte{})
+			}
+		case "signal":
+			sigReq := &SignalRequest{}
+			if err := ssh.Unmarshal(req.Payload, sigReq); err != nil {
+				dbg.Debug("Error unmarshaling signal: %v", err)
+				continue
+			}
+			dbg.Debug("Signal: %s", sigReq.Signal)
+			if err := sess.signal(sigReq.Signal); err != nil {
+				dbg.Debug("Unable to deliver signal %s: %v", sigReq.Signal, err)
+			}
+		case "break":
+			success = false
+			if err := sess.sendBreak(); err != nil {
+				dbg.Debug("Unable to send break: %v", err)
+			} else {
+				success = true
+			}
+			if req.WantReply {
+				req.Reply(success, []byte{})
 			}
-			return
 		default:
 			dbg.Debug("Unknown session request: %s", req.Type)
 			if req.WantReply {
@@ -248,29 +524,72 @@ func (conn *ServerConn) HandleSessionChannel(wg *sync.WaitGroup, newChan ssh.New
 	}
 }
 
-// Execute a process for the channel.
-func (conn *ServerConn) ExecuteForChannel(shellCmd []string, ch ssh.Channel) {
+// Run the command forced by the key's command= option in place of
+// whatever the client asked for.
+func (conn *ServerConn) runForcedCommand(origCmd string, sess *session) exitStatus {
+	dbg.Debug("Forced command: %s (requested %q)", conn.opts.Command, origCmd)
+	var extraEnv []string
+	if origCmd != "" {
+		extraEnv = append(extraEnv, "SSH_ORIGINAL_COMMAND="+origCmd)
+	}
+	if cmd, err := shlex.Split(conn.opts.Command); err == nil && len(cmd) > 0 && cmd[0] == "scp" {
+		if err := conn.SCPHandler(cmd, sess.ch); err != nil {
+			dbg.Debug("scp failure: %v", err)
+			return exitStatus{Status: 1}
+		}
+		return exitStatus{}
+	}
+	return conn.ExecuteForChannel(commandWithShell(conn.shellExe(), conn.opts.Command), sess, extraEnv...)
+}
+
+// Execute a process for the session and report how it ended.
+func (conn *ServerConn) ExecuteForChannel(shellCmd []string, sess *session, extraEnv ...string) exitStatus {
 	dbg.Debug("Executing %v", shellCmd)
+	ch := sess.ch
 	proc := exec.Command(shellCmd[0], shellCmd[1:]...)
-	proc.Env = append([]string{}, conn.environ...)
-	proc.Env = append([]string{}, syscall.Environ()...)
-
-	if userInfo, err := user.Current(); err == nil {
-		proc.Dir = userInfo.HomeDir
+	if sess.loginShell && runtime.GOOS != "windows" {
+		// A leading "-" tells the shell to run its profile scripts.
+		proc.Args[0] = "-" + filepath.Base(shellCmd[0])
 	}
-	if conn.pty == nil {
+	proc.Env = conn.sessionEnv(sess, extraEnv...)
+	proc.Dir = conn.homeDir()
+	if _, err := os.Stat(proc.Dir); proc.Dir != "" && err != nil {
+		dbg.Debug("Could not use home directory: %v", err)
+		proc.Dir = ""
+	}
+	if sess.pty == nil {
 		stdin, _ := proc.StdinPipe()
-		go io.Copy(stdin, ch)
+		go func() {
+			// The client's EOF is the command's EOF.
+			io.Copy(stdin, ch)
+			stdin.Close()
+		}()
+		// Wait returns only once both have been copied to the channel.
 		proc.Stdout = ch
-		proc.Stderr = ch
+		proc.Stderr = ch.Stderr()
+		setProcessGroup(proc)
 	} else {
-		conn.pty.AttachPty(proc)
-		conn.pty.AttachIO(ch, ch)
+		conn.startRecording(sess, strings.Join(shellCmd, " "))
+		sess.attachPty(proc)
+		if err := chownToAccount(conn.account, sess.pty.Tty.Name()); err != nil {
+			dbg.Debug("Unable to hand over tty: %v", err)
+		}
+	}
+	// Never fall back to running another account's command as ourselves.
+	if err := setCredential(proc, conn.account); err != nil {
+		dbg.Warn("Unable to run as %s: %v", conn.account.Username, err)
+		return exitStatus{Status: 1}
 	}
 	//proc.Run()
-	err := exec2.Run(proc)
+	err := exec2.Start(proc)
+	if err == nil {
+		sess.setProcess(proc.Process)
+		err = proc.Wait()
+		sess.setProcess(nil)
+	}
 
 	dbg.Debug("Finished execution. Err: %v", err)
+	return exitStatusFromError(err)
 }
 
 // Message for port forwarding
@@ -290,8 +609,13 @@ func (conn *ServerConn) HandleTCPIPChannel(wg *sync.WaitGroup, newChan ssh.NewCh
 		return
 	}
 	dbg.Debug("Forwarding request: %v", msg)
+	if !conn.opts.permitsOpen(msg.Host, msg.Port) {
+		dbg.Debug("Forward to %s:%d refused by key options.", msg.Host, msg.Port)
+		newChan.Reject(ssh.Prohibited, "Port forwarding not permitted.")
+		return
+	}
 
-	outbound, err := net.Dial("tcp", fmt.Sprintf("%s:%d", msg.Host, msg.Port))
+	outbound, err := net.Dial("tcp", net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))))
 	if err != nil {
 		dbg.Debug("Unable to dial forward: %v", err)
 		newChan.Reject(ssh.ConnectionFailed, err.Error())
@@ -299,26 +623,6 @@ func (conn *ServerConn) HandleTCPIPChannel(wg *sync.WaitGroup, newChan ssh.NewCh
 	}
 	defer outbound.Close()
 
-	ch, reqs, err := newChan.Accept()
-	if err != nil {
-		dbg.Debug("Unable to accept chan: %v", err)
-		return
-	}
-	defer ch.Close()
-
-	go func() {
-		for req := range reqs {
-			switch req.Type {
-			default:
-				dbg.Debug("Unknown direct-tcpip request: %s", req.Type)
-				if req.WantReply {
-					req.Reply(false, []byte{})
-				}
-			}
-		}
-	}()
-	go io.Copy(ch, outbound)
-	io.Copy(outbound, ch)
-
+	conn.pipeForwardChannel(newChan, outbound, outbound.RemoteAddr().String())
 	dbg.Debug("Closing forwarding request: %v", msg)
 }
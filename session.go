@@ -0,0 +1,245 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// State of a single session channel.
+package main
+
+import (
+	"errors"
+	"github.com/Matir/sshdog/pty"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoProcess    = errors.New("No process running.")
+	ErrNoPty        = errors.New("No pty allocated.")
+	ErrPtyAllocated = errors.New("Pty already allocated.")
+)
+
+const (
+	// How long to keep copying pty output after the command exits
+	ptyDrainDeadline = time.Second
+	// Time between SIGHUP and SIGKILL when hanging up on a command
+	defaultHangupGrace = 5 * time.Second
+)
+
+// Everything belonging to one session channel.  The request loop in
+// HandleSessionChannel sets it up before the command starts and only
+// reads it afterwards, except for the fields under mu.
+type session struct {
+	ch     ssh.Channel
+	pty    *pty.Pty // nil unless the client asked for one
+	output <-chan struct{}
+	env    []string // accepted client variables
+	term   string
+	status exitStatus
+
+	loginShell bool // run the shell as a login shell
+
+	agent    net.Listener // nil unless forwarding the client's agent
+	agentDir string
+	x11      *x11Forward // nil unless forwarding X11
+
+	recordInput bool
+
+	// mu guards what the request loop and the command share
+	mu         sync.Mutex
+	proc       *os.Process // nil unless a command is running
+	group      *os.Process // leader of the command's process group, once started
+	cols, rows uint32
+	recorder   *castRecorder // nil unless recording
+}
+
+func newSession(ch ssh.Channel) *session {
+	return &session{ch: ch}
+}
+
+// Allocate a pty as described by a pty-req
+func (sess *session) openPty(req *PTYRequest) error {
+	if sess.pty != nil {
+		return ErrPtyAllocated
+	}
+	p, err := pty.OpenPty()
+	if err != nil {
+		return err
+	}
+	if err := p.Resize(uint16(req.Height), uint16(req.Width), uint16(req.WidthPx), uint16(req.HeightPx)); err != nil {
+		dbg.Debug("Unable to size pty: %v", err)
+	}
+	if modes, err := pty.DecodeModes([]byte(req.Modes)); err != nil {
+		dbg.Debug("Error decoding pty modes: %v", err)
+	} else if err := p.SetModes(modes); err != nil {
+		dbg.Debug("Unable to set pty modes: %v", err)
+	}
+	sess.pty = p
+	sess.term = req.Term
+	sess.cols, sess.rows = req.Width, req.Height
+	return nil
+}
+
+func (sess *session) resize(req *WindowChangeRequest) error {
+	if sess.pty == nil {
+		return ErrNoPty
+	}
+	sess.mu.Lock()
+	sess.cols, sess.rows = req.Width, req.Height
+	if sess.recorder != nil {
+		sess.recorder.resize(req.Width, req.Height)
+	}
+	sess.mu.Unlock()
+	return sess.pty.Resize(uint16(req.Height), uint16(req.Width), uint16(req.WidthPx), uint16(req.HeightPx))
+}
+
+func (sess *session) sendBreak() error {
+	if sess.pty == nil {
+		return ErrNoPty
+	}
+	return sess.pty.SendBreak()
+}
+
+// Connect the command to the pty and the pty to the channel
+func (sess *session) attachPty(proc *exec.Cmd) {
+	sess.pty.AttachPty(proc)
+	var in io.Reader = sess.ch
+	var out io.Writer = sess.ch
+	if sess.recorder != nil {
+		out = io.MultiWriter(out, &castStream{r: sess.recorder, code: "o"})
+		if sess.recordInput {
+			in = io.TeeReader(in, &castStream{r: sess.recorder, code: "i"})
+		}
+	}
+	sess.output = sess.pty.AttachIO(in, out)
+}
+
+func (sess *session) setProcess(proc *os.Process) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.proc = proc
+	if proc != nil {
+		sess.group = proc
+	}
+}
+
+// Deliver an RFC 4254 signal to the session's command
+func (sess *session) signal(name string) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.proc == nil {
+		return ErrNoProcess
+	}
+	return signalProcessGroup(sess.proc, name)
+}
+
+// Hang up on the command: SIGHUP its process group now and SIGKILL
+// whatever is left of it after grace.  The group outlives its leader, so
+// this also catches descendants of a command that already exited.  Once
+// the group is gone its id may be reused, so it's left alone from then on.
+func (sess *session) hangup(grace time.Duration) {
+	sess.mu.Lock()
+	group := sess.group
+	sess.mu.Unlock()
+	if group == nil || !processGroupExists(group) {
+		return
+	}
+	dbg.Debug("Hanging up on process group %d.", group.Pid)
+	signalProcessGroup(group, "HUP")
+	time.AfterFunc(grace, func() {
+		if processGroupExists(group) {
+			signalProcessGroup(group, "KILL")
+		}
+	})
+}
+
+// Release everything the session holds: flush what the command wrote to
+// the pty, send EOF and report how it ended, then close the pty and the
+// channel.
+func (sess *session) close() {
+	if sess.pty != nil {
+		sess.pty.CloseTty()
+		if sess.output != nil {
+			// Background jobs may hold the tty open; don't wait on them.
+			select {
+			case <-sess.output:
+			case <-time.After(ptyDrainDeadline):
+				dbg.Debug("Timed out flushing pty output.")
+			}
+		}
+	}
+	sess.ch.CloseWrite()
+	if sess.recorder != nil {
+		sess.recorder.Close()
+	}
+	sess.status.send(sess.ch)
+	if sess.pty != nil {
+		sess.pty.Close()
+	}
+	sess.closeAgent()
+	if sess.x11 != nil {
+		sess.x11.close()
+	}
+	dbg.Debug("Closing session channel.")
+	sess.ch.Close()
+}
+
+// The sessions of a server, so they can be hung up on at shutdown
+type sessionSet struct {
+	sync.Mutex
+	sessions map[*session]bool
+	wg       sync.WaitGroup
+}
+
+func (set *sessionSet) add(sess *session) {
+	set.Lock()
+	defer set.Unlock()
+	if set.sessions == nil {
+		set.sessions = make(map[*session]bool)
+	}
+	set.sessions[sess] = true
+	set.wg.Add(1)
+}
+
+func (set *sessionSet) remove(sess *session) {
+	set.Lock()
+	defer set.Unlock()
+	if set.sessions[sess] {
+		delete(set.sessions, sess)
+		set.wg.Done()
+	}
+}
+
+// Hang up on every session and wait, for at most grace plus a little,
+// for them to finish.
+func (set *sessionSet) hangupAll(grace time.Duration) {
+	set.Lock()
+	for sess := range set.sessions {
+		sess.hangup(grace)
+	}
+	set.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		set.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(grace + time.Second):
+		dbg.Debug("Gave up waiting for sessions to finish.")
+	}
+}
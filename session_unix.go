@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Send a signal to the process group led by proc, or just to proc if it
+// doesn't lead one.
+func signalProcessGroup(proc *os.Process, name string) error {
+	sig, ok := sshSignals[name]
+	if !ok {
+		return fmt.Errorf("Unknown signal %q", name)
+	}
+	if err := syscall.Kill(-proc.Pid, sig); err == nil {
+		return nil
+	}
+	return proc.Signal(sig)
+}
+
+// Is anything left of the process group led by proc, or of proc itself if
+// it doesn't lead one?
+func processGroupExists(proc *os.Process) bool {
+	if err := syscall.Kill(-proc.Pid, 0); err == nil || err == syscall.EPERM {
+		return true
+	}
+	// Refused once proc has been waited for
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// Start the command in a process group of its own, so the whole tree can
+// be signalled at once.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Start the command as account, with its primary and supplementary
+// groups, when that isn't us.
+func setCredential(cmd *exec.Cmd, account *user.User) error {
+	if !switchesUser(account) {
+		return nil
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	groupIds, err := account.GroupIds()
+	if err != nil {
+		return err
+	}
+	var groups []uint32
+	for _, id := range groupIds {
+		if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups = append(groups, uint32(g))
+		}
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+	}
+	return nil
+}
+
+// Hand files we made for a session (its tty, agent socket, Xauthority)
+// to the account it runs as.
+func chownToAccount(account *user.User, paths ...string) error {
+	if !switchesUser(account) {
+		return nil
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestProcessGroupExists(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 0.2 & exit 0")
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	// The leader is gone but its background child still holds the group.
+	if !processGroupExists(cmd.Process) {
+		t.Error("group with a live member reported gone")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for processGroupExists(cmd.Process) {
+		if time.Now().After(deadline) {
+			t.Fatal("group still reported after its last member exited")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
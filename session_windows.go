@@ -0,0 +1,56 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"syscall"
+)
+
+// Windows has no signals; the best we can do is terminate the process.
+func signalProcessGroup(proc *os.Process, name string) error {
+	switch name {
+	case "KILL", "TERM", "INT", "HUP":
+		return proc.Kill()
+	}
+	return fmt.Errorf("Unsupported signal %q", name)
+}
+
+// Without groups there's only the process, and Kill is refused once it
+// has been waited for.
+func processGroupExists(proc *os.Process) bool {
+	return true
+}
+
+// Keep the command out of our console group.  Signals only ever reach
+// the process itself, not its children.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// Sessions always run as us on windows.
+func setCredential(cmd *exec.Cmd, account *user.User) error {
+	return nil
+}
+
+func chownToAccount(account *user.User, paths ...string) error {
+	return nil
+}
@@ -0,0 +1,1000 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Built-in SFTP (version 3) subsystem, as described by
+// draft-ietf-secsh-filexfer-02 and the OpenSSH PROTOCOL file.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var sftpLog = dbg.Subsystem("sftp")
+
+const (
+	sftpProtocolVersion = 3
+	// Largest packet we accept; OpenSSH uses the same limit.
+	sftpMaxPacket = 256 * 1024
+	// Largest read we will serve in a single SSH_FXP_DATA.
+	sftpMaxRead = 32 * 1024
+	// Entries returned per SSH_FXP_READDIR.
+	sftpReaddirBatch = 128
+)
+
+// Packet types
+const (
+	sftpInit          = 1
+	sftpVersion       = 2
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpRead          = 5
+	sftpWrite         = 6
+	sftpLstat         = 7
+	sftpFstat         = 8
+	sftpSetstat       = 9
+	sftpFsetstat      = 10
+	sftpOpendir       = 11
+	sftpReaddir       = 12
+	sftpRemove        = 13
+	sftpMkdir         = 14
+	sftpRmdir         = 15
+	sftpRealpath      = 16
+	sftpStat          = 17
+	sftpRename        = 18
+	sftpReadlink      = 19
+	sftpSymlink       = 20
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpData          = 103
+	sftpName          = 104
+	sftpAttrs         = 105
+	sftpExtended      = 200
+	sftpExtendedReply = 201
+)
+
+// Status codes
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// Open flags
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+// Attribute flags
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+// POSIX file type bits, as sent in the permissions attribute
+const (
+	sIFMT   = 0170000
+	sIFSOCK = 0140000
+	sIFLNK  = 0120000
+	sIFREG  = 0100000
+	sIFBLK  = 0060000
+	sIFDIR  = 0040000
+	sIFCHR  = 0020000
+	sIFIFO  = 0010000
+)
+
+var (
+	ErrSFTPShortPacket = errors.New("Short SFTP packet.")
+	ErrSFTPBadHandle   = errors.New("Invalid SFTP handle.")
+)
+
+// Attributes of a file, as sent over the wire
+type sftpAttr struct {
+	Flags uint32
+	Size  uint64
+	UID   uint32
+	GID   uint32
+	Mode  uint32
+	Atime uint32
+	Mtime uint32
+}
+
+// An open file or directory
+type sftpOpenFile struct {
+	file    *os.File
+	path    string
+	dir     bool
+	dirDone bool
+	write   bool  // opened for writing
+	read    int64 // bytes sent to the client
+	written int64 // bytes received from it
+}
+
+// State for one SFTP session
+type sftpServer struct {
+	conn       *ServerConn
+	ch         ssh.Channel
+	in         *bufio.Reader
+	out        *bufio.Writer
+	home       string
+	handles    map[string]*sftpOpenFile
+	nextHandle uint64
+}
+
+// Serve the SFTP subsystem on a session channel until the client hangs up.
+func (conn *ServerConn) SFTPHandler(ch ssh.Channel) error {
+	home, _ := os.Getwd()
+	if dir := conn.homeDir(); dir != "" {
+		home = dir
+	}
+	srv := &sftpServer{
+		conn:    conn,
+		ch:      ch,
+		in:      bufio.NewReader(ch),
+		out:     bufio.NewWriter(ch),
+		home:    home,
+		handles: make(map[string]*sftpOpenFile),
+	}
+	defer srv.closeAll()
+	err := srv.serve()
+	ch.CloseWrite()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s *sftpServer) serve() error {
+	for {
+		pktType, payload, err := s.readPacket()
+		if err != nil {
+			return err
+		}
+		if pktType == sftpInit {
+			if err := s.sendVersion(); err != nil {
+				return err
+			}
+			continue
+		}
+		buf := &sftpBuffer{payload}
+		id, err := buf.uint32()
+		if err != nil {
+			return err
+		}
+		if err := s.dispatch(pktType, id, buf); err != nil {
+			return err
+		}
+		if err := s.out.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpServer) readPacket() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(s.in, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:4])
+	if length < 1 || length > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("SFTP packet length %d out of range", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(s.in, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], payload, nil
+}
+
+func (s *sftpServer) sendPacket(pktType byte, data []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)+1))
+	hdr[4] = pktType
+	if _, err := s.out.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := s.out.Write(data)
+	return err
+}
+
+func (s *sftpServer) sendVersion() error {
+	b := &sftpBuilder{}
+	b.uint32(sftpProtocolVersion)
+	b.string("posix-rename@openssh.com")
+	b.string("1")
+	b.string("fsync@openssh.com")
+	b.string("1")
+	if err := s.sendPacket(sftpVersion, b.buf); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+func (s *sftpServer) sendStatus(id uint32, err error) error {
+	code, msg := uint32(sftpOK), "Success"
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		code, msg = sftpEOF, "End of file"
+	case err == ErrSFTPShortPacket:
+		code, msg = sftpBadMessage, err.Error()
+	case os.IsNotExist(err):
+		code, msg = sftpNoSuchFile, err.Error()
+	case os.IsPermission(err):
+		code, msg = sftpPermissionDenied, err.Error()
+	default:
+		code, msg = sftpFailure, err.Error()
+	}
+	if err != nil && err != io.EOF {
+		sftpLog.Debug("sftp error: %v", err)
+	}
+	b := &sftpBuilder{}
+	b.uint32(id)
+	b.uint32(code)
+	b.string(msg)
+	b.string("")
+	return s.sendPacket(sftpStatus, b.buf)
+}
+
+func (s *sftpServer) sendUnsupported(id uint32) error {
+	b := &sftpBuilder{}
+	b.uint32(id)
+	b.uint32(sftpOpUnsupported)
+	b.string("Operation unsupported")
+	b.string("")
+	return s.sendPacket(sftpStatus, b.buf)
+}
+
+func (s *sftpServer) sendHandle(id uint32, handle string) error {
+	b := &sftpBuilder{}
+	b.uint32(id)
+	b.string(handle)
+	return s.sendPacket(sftpHandle, b.buf)
+}
+
+func (s *sftpServer) sendAttrs(id uint32, fi os.FileInfo) error {
+	b := &sftpBuilder{}
+	b.uint32(id)
+	b.attr(fileInfoToAttr(fi))
+	return s.sendPacket(sftpAttrs, b.buf)
+}
+
+// Send a single name with dummy attributes, as used by REALPATH and READLINK
+func (s *sftpServer) sendSingleName(id uint32, name string) error {
+	b := &sftpBuilder{}
+	b.uint32(id)
+	b.uint32(1)
+	b.string(name)
+	b.string(name)
+	b.attr(&sftpAttr{})
+	return s.sendPacket(sftpName, b.buf)
+}
+
+// Resolve a client supplied path relative to the session's home directory
+func (s *sftpServer) localPath(p string) string {
+	if p == "" {
+		return s.home
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(s.home, p)
+	}
+	return filepath.Clean(p)
+}
+
+func (s *sftpServer) newHandle(h *sftpOpenFile) string {
+	s.nextHandle++
+	name := strconv.FormatUint(s.nextHandle, 10)
+	s.handles[name] = h
+	return name
+}
+
+func (s *sftpServer) getHandle(buf *sftpBuffer) (string, *sftpOpenFile, error) {
+	name, err := buf.string()
+	if err != nil {
+		return "", nil, err
+	}
+	h, ok := s.handles[name]
+	if !ok {
+		return name, nil, ErrSFTPBadHandle
+	}
+	return name, h, nil
+}
+
+func (s *sftpServer) closeAll() {
+	for name, h := range s.handles {
+		h.file.Close()
+		s.auditTransfer(h, errors.New("session ended before close"))
+		delete(s.handles, name)
+	}
+}
+
+// Record what was transferred through a file handle
+func (s *sftpServer) auditTransfer(h *sftpOpenFile, err error) {
+	if h.dir {
+		return
+	}
+	direction, size := "download", h.read
+	if h.write && (h.written > 0 || h.read == 0) {
+		direction, size = "upload", h.written
+	}
+	s.conn.auditResult("sftp", auditFields{
+		"op":        "transfer",
+		"direction": direction,
+		"path":      h.path,
+		"bytes":     size,
+	}, err)
+}
+
+// Record a change to the file tree
+func (s *sftpServer) auditChange(op, path, newPath string, err error) {
+	fields := auditFields{"op": op, "path": path}
+	if newPath != "" {
+		fields["new_path"] = newPath
+	}
+	s.conn.auditResult("sftp", fields, err)
+}
+
+func (s *sftpServer) dispatch(pktType byte, id uint32, buf *sftpBuffer) error {
+	switch pktType {
+	case sftpOpen:
+		return s.handleOpen(id, buf)
+	case sftpClose:
+		name, h, err := s.getHandle(buf)
+		if err == nil {
+			delete(s.handles, name)
+			err = h.file.Close()
+			s.auditTransfer(h, err)
+		}
+		return s.sendStatus(id, err)
+	case sftpRead:
+		return s.handleRead(id, buf)
+	case sftpWrite:
+		return s.handleWrite(id, buf)
+	case sftpLstat, sftpStat:
+		p, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		var fi os.FileInfo
+		if pktType == sftpLstat {
+			fi, err = os.Lstat(s.localPath(p))
+		} else {
+			fi, err = os.Stat(s.localPath(p))
+		}
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendAttrs(id, fi)
+	case sftpFstat:
+		_, h, err := s.getHandle(buf)
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		fi, err := h.file.Stat()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendAttrs(id, fi)
+	case sftpSetstat:
+		p, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		attr, err := buf.attr()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendStatus(id, applyAttr(s.localPath(p), nil, attr))
+	case sftpFsetstat:
+		_, h, err := s.getHandle(buf)
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		attr, err := buf.attr()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendStatus(id, applyAttr(h.path, h.file, attr))
+	case sftpOpendir:
+		p, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		path := s.localPath(p)
+		fp, err := os.Open(path)
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		if fi, err := fp.Stat(); err != nil || !fi.IsDir() {
+			fp.Close()
+			if err == nil {
+				err = ErrNotDirectory
+			}
+			return s.sendStatus(id, err)
+		}
+		return s.sendHandle(id, s.newHandle(&sftpOpenFile{file: fp, path: path, dir: true}))
+	case sftpReaddir:
+		return s.handleReaddir(id, buf)
+	case sftpRemove:
+		p, err := buf.string()
+		if err == nil {
+			path := s.localPath(p)
+			if fi, serr := os.Lstat(path); serr == nil && fi.IsDir() {
+				err = fmt.Errorf("%s is a directory", p)
+			} else {
+				err = os.Remove(path)
+			}
+			s.auditChange("remove", path, "", err)
+		}
+		return s.sendStatus(id, err)
+	case sftpMkdir:
+		p, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		attr, err := buf.attr()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		mode := os.FileMode(0755)
+		if attr.Flags&sftpAttrPermissions != 0 {
+			mode = os.FileMode(attr.Mode & 0777)
+		}
+		path := s.localPath(p)
+		err = os.Mkdir(path, mode)
+		s.auditChange("mkdir", path, "", err)
+		return s.sendStatus(id, err)
+	case sftpRmdir:
+		p, err := buf.string()
+		if err == nil {
+			path := s.localPath(p)
+			if fi, serr := os.Lstat(path); serr == nil && !fi.IsDir() {
+				err = ErrNotDirectory
+			} else {
+				err = os.Remove(path)
+			}
+			s.auditChange("rmdir", path, "", err)
+		}
+		return s.sendStatus(id, err)
+	case sftpRealpath:
+		p, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendSingleName(id, filepath.ToSlash(s.localPath(p)))
+	case sftpRename:
+		oldPath, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		newPath, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		from, to := s.localPath(oldPath), s.localPath(newPath)
+		// SFTPv3 rename must not overwrite an existing target.
+		if _, err := os.Lstat(to); err == nil {
+			s.auditChange("rename", from, to, os.ErrExist)
+			return s.sendStatus(id, os.ErrExist)
+		}
+		err = os.Rename(from, to)
+		s.auditChange("rename", from, to, err)
+		return s.sendStatus(id, err)
+	case sftpReadlink:
+		p, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		target, err := os.Readlink(s.localPath(p))
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendSingleName(id, target)
+	case sftpSymlink:
+		// OpenSSH sends the arguments in the reverse order from the
+		// draft: target first, then the link path.  Every client
+		// written against OpenSSH expects this, so we do too.
+		target, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		link, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendStatus(id, os.Symlink(target, s.localPath(link)))
+	case sftpExtended:
+		return s.handleExtended(id, buf)
+	default:
+		sftpLog.Debug("Unknown SFTP packet type: %d", pktType)
+		return s.sendUnsupported(id)
+	}
+}
+
+func (s *sftpServer) handleOpen(id uint32, buf *sftpBuffer) error {
+	p, err := buf.string()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	pflags, err := buf.uint32()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	attr, err := buf.attr()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+
+	var flags int
+	switch {
+	case pflags&sftpFlagRead != 0 && pflags&sftpFlagWrite != 0:
+		flags = os.O_RDWR
+	case pflags&sftpFlagWrite != 0:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+	if pflags&sftpFlagAppend != 0 {
+		flags |= os.O_APPEND
+	}
+	if pflags&sftpFlagCreat != 0 {
+		flags |= os.O_CREATE
+	}
+	if pflags&sftpFlagTrunc != 0 {
+		flags |= os.O_TRUNC
+	}
+	if pflags&sftpFlagExcl != 0 {
+		flags |= os.O_EXCL
+	}
+	mode := os.FileMode(0644)
+	if attr.Flags&sftpAttrPermissions != 0 {
+		mode = os.FileMode(attr.Mode & 0777)
+	}
+
+	path := s.localPath(p)
+	sftpLog.Debug("sftp open %s flags 0x%x", path, pflags)
+	fp, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	return s.sendHandle(id, s.newHandle(&sftpOpenFile{
+		file:  fp,
+		path:  path,
+		write: pflags&sftpFlagWrite != 0,
+	}))
+}
+
+func (s *sftpServer) handleRead(id uint32, buf *sftpBuffer) error {
+	_, h, err := s.getHandle(buf)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	offset, err := buf.uint64()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	length, err := buf.uint32()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	if length > sftpMaxRead {
+		length = sftpMaxRead
+	}
+	data := make([]byte, length)
+	n, err := h.file.ReadAt(data, int64(offset))
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return s.sendStatus(id, err)
+	}
+	h.read += int64(n)
+	b := &sftpBuilder{}
+	b.uint32(id)
+	b.bytes(data[:n])
+	return s.sendPacket(sftpData, b.buf)
+}
+
+func (s *sftpServer) handleWrite(id uint32, buf *sftpBuffer) error {
+	_, h, err := s.getHandle(buf)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	offset, err := buf.uint64()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	data, err := buf.bytes()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	_, err = h.file.WriteAt(data, int64(offset))
+	if err != nil && errors.Is(err, os.ErrInvalid) {
+		// WriteAt refuses files opened with O_APPEND
+		_, err = h.file.Write(data)
+	}
+	if err == nil {
+		h.written += int64(len(data))
+	}
+	return s.sendStatus(id, err)
+}
+
+func (s *sftpServer) handleReaddir(id uint32, buf *sftpBuffer) error {
+	_, h, err := s.getHandle(buf)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	if !h.dir {
+		return s.sendStatus(id, ErrNotDirectory)
+	}
+	if h.dirDone {
+		return s.sendStatus(id, io.EOF)
+	}
+	names, err := h.file.Readdirnames(sftpReaddirBatch)
+	if len(names) == 0 {
+		h.dirDone = true
+		if err == nil {
+			err = io.EOF
+		}
+		return s.sendStatus(id, err)
+	}
+	b := &sftpBuilder{}
+	b.uint32(id)
+	count := 0
+	entries := &sftpBuilder{}
+	for _, name := range names {
+		fi, err := os.Lstat(filepath.Join(h.path, name))
+		if err != nil {
+			continue
+		}
+		entries.string(name)
+		entries.string(sftpLongName(fi))
+		entries.attr(fileInfoToAttr(fi))
+		count++
+	}
+	b.uint32(uint32(count))
+	b.buf = append(b.buf, entries.buf...)
+	return s.sendPacket(sftpName, b.buf)
+}
+
+func (s *sftpServer) handleExtended(id uint32, buf *sftpBuffer) error {
+	name, err := buf.string()
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	sftpLog.Debug("sftp extended request: %s", name)
+	switch name {
+	case "posix-rename@openssh.com":
+		oldPath, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		newPath, err := buf.string()
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		from, to := s.localPath(oldPath), s.localPath(newPath)
+		err = os.Rename(from, to)
+		s.auditChange("rename", from, to, err)
+		return s.sendStatus(id, err)
+	case "fsync@openssh.com":
+		_, h, err := s.getHandle(buf)
+		if err == nil {
+			err = h.file.Sync()
+		}
+		return s.sendStatus(id, err)
+	default:
+		return s.sendUnsupported(id)
+	}
+}
+
+// Apply attributes to a path, or to an already open file if given
+func applyAttr(path string, fp *os.File, attr *sftpAttr) error {
+	if attr.Flags&sftpAttrSize != 0 {
+		var err error
+		if fp != nil {
+			err = fp.Truncate(int64(attr.Size))
+		} else {
+			err = os.Truncate(path, int64(attr.Size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Ownership first: chown clears the setuid and setgid bits.
+	if attr.Flags&sftpAttrUIDGID != 0 {
+		var err error
+		if fp != nil {
+			err = fp.Chown(int(attr.UID), int(attr.GID))
+		} else {
+			err = os.Lchown(path, int(attr.UID), int(attr.GID))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if attr.Flags&sftpAttrPermissions != 0 {
+		mode := sftpModeToFileMode(attr.Mode)
+		var err error
+		if fp != nil {
+			err = fp.Chmod(mode)
+		} else {
+			err = os.Chmod(path, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if attr.Flags&sftpAttrACModTime != 0 {
+		atime := time.Unix(int64(attr.Atime), 0)
+		mtime := time.Unix(int64(attr.Mtime), 0)
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileInfoToAttr(fi os.FileInfo) *sftpAttr {
+	attr := &sftpAttr{
+		Flags: sftpAttrSize | sftpAttrPermissions | sftpAttrACModTime,
+		Size:  uint64(fi.Size()),
+		Mode:  fileModeToSFTPMode(fi.Mode()),
+		Atime: uint32(fileAccessTime(fi).Unix()),
+		Mtime: uint32(fi.ModTime().Unix()),
+	}
+	if uid, gid, ok := fileOwner(fi); ok {
+		attr.Flags |= sftpAttrUIDGID
+		attr.UID = uid
+		attr.GID = gid
+	}
+	return attr
+}
+
+func fileModeToSFTPMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		m |= sIFDIR
+	case mode&os.ModeSymlink != 0:
+		m |= sIFLNK
+	case mode&os.ModeNamedPipe != 0:
+		m |= sIFIFO
+	case mode&os.ModeSocket != 0:
+		m |= sIFSOCK
+	case mode&os.ModeCharDevice != 0:
+		m |= sIFCHR
+	case mode&os.ModeDevice != 0:
+		m |= sIFBLK
+	default:
+		m |= sIFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+func sftpModeToFileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// Build an "ls -l" style line, which is what clients show for ls -l
+func sftpLongName(fi os.FileInfo) string {
+	m := fileModeToSFTPMode(fi.Mode())
+	perms := []byte("----------")
+	switch m & sIFMT {
+	case sIFDIR:
+		perms[0] = 'd'
+	case sIFLNK:
+		perms[0] = 'l'
+	case sIFIFO:
+		perms[0] = 'p'
+	case sIFSOCK:
+		perms[0] = 's'
+	case sIFCHR:
+		perms[0] = 'c'
+	case sIFBLK:
+		perms[0] = 'b'
+	}
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if m&(1<<uint(8-i)) != 0 {
+			perms[i+1] = rwx[i]
+		}
+	}
+	owner, group := "0", "0"
+	if uid, gid, ok := fileOwner(fi); ok {
+		owner = strconv.FormatUint(uint64(uid), 10)
+		group = strconv.FormatUint(uint64(gid), 10)
+	}
+	date := fi.ModTime().Format("Jan _2 15:04")
+	if time.Since(fi.ModTime()) > 180*24*time.Hour {
+		date = fi.ModTime().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s    1 %-8s %-8s %8d %s %s",
+		perms, owner, group, fi.Size(), date, fi.Name())
+}
+
+// Reads SFTP wire types from a packet payload
+type sftpBuffer struct {
+	data []byte
+}
+
+func (b *sftpBuffer) uint32() (uint32, error) {
+	if len(b.data) < 4 {
+		return 0, ErrSFTPShortPacket
+	}
+	v := binary.BigEndian.Uint32(b.data)
+	b.data = b.data[4:]
+	return v, nil
+}
+
+func (b *sftpBuffer) uint64() (uint64, error) {
+	if len(b.data) < 8 {
+		return 0, ErrSFTPShortPacket
+	}
+	v := binary.BigEndian.Uint64(b.data)
+	b.data = b.data[8:]
+	return v, nil
+}
+
+func (b *sftpBuffer) bytes() ([]byte, error) {
+	n, err := b.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(b.data)) < n {
+		return nil, ErrSFTPShortPacket
+	}
+	v := b.data[:n]
+	b.data = b.data[n:]
+	return v, nil
+}
+
+func (b *sftpBuffer) string() (string, error) {
+	v, err := b.bytes()
+	return string(v), err
+}
+
+func (b *sftpBuffer) attr() (*sftpAttr, error) {
+	attr := &sftpAttr{}
+	var err error
+	if attr.Flags, err = b.uint32(); err != nil {
+		return nil, err
+	}
+	if attr.Flags&sftpAttrSize != 0 {
+		if attr.Size, err = b.uint64(); err != nil {
+			return nil, err
+		}
+	}
+	if attr.Flags&sftpAttrUIDGID != 0 {
+		if attr.UID, err = b.uint32(); err != nil {
+			return nil, err
+		}
+		if attr.GID, err = b.uint32(); err != nil {
+			return nil, err
+		}
+	}
+	if attr.Flags&sftpAttrPermissions != 0 {
+		if attr.Mode, err = b.uint32(); err != nil {
+			return nil, err
+		}
+	}
+	if attr.Flags&sftpAttrACModTime != 0 {
+		if attr.Atime, err = b.uint32(); err != nil {
+			return nil, err
+		}
+		if attr.Mtime, err = b.uint32(); err != nil {
+			return nil, err
+		}
+	}
+	if attr.Flags&sftpAttrExtended != 0 {
+		count, err := b.uint32()
+		if err != nil {
+			return nil, err
+		}
+		// Extended attributes are parsed and ignored.
+		for i := uint32(0); i < count; i++ {
+			if _, err := b.bytes(); err != nil {
+				return nil, err
+			}
+			if _, err := b.bytes(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return attr, nil
+}
+
+// Builds an SFTP packet payload
+type sftpBuilder struct {
+	buf []byte
+}
+
+func (b *sftpBuilder) uint32(v uint32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+func (b *sftpBuilder) uint64(v uint64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+func (b *sftpBuilder) bytes(v []byte) {
+	b.uint32(uint32(len(v)))
+	b.buf = append(b.buf, v...)
+}
+
+func (b *sftpBuilder) string(v string) {
+	b.uint32(uint32(len(v)))
+	b.buf = append(b.buf, v...)
+}
+
+func (b *sftpBuilder) attr(attr *sftpAttr) {
+	b.uint32(attr.Flags)
+	if attr.Flags&sftpAttrSize != 0 {
+		b.uint64(attr.Size)
+	}
+	if attr.Flags&sftpAttrUIDGID != 0 {
+		b.uint32(attr.UID)
+		b.uint32(attr.GID)
+	}
+	if attr.Flags&sftpAttrPermissions != 0 {
+		b.uint32(attr.Mode)
+	}
+	if attr.Flags&sftpAttrACModTime != 0 {
+		b.uint32(attr.Atime)
+		b.uint32(attr.Mtime)
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var sftpAttrVectors = []struct {
+	name string
+	attr sftpAttr
+	wire []byte
+}{
+	{
+		"empty",
+		sftpAttr{},
+		[]byte{0, 0, 0, 0},
+	},
+	{
+		"size",
+		sftpAttr{Flags: sftpAttrSize, Size: 0x0102030405060708},
+		[]byte{0, 0, 0, 1, 1, 2, 3, 4, 5, 6, 7, 8},
+	},
+	{
+		"owner and mode",
+		sftpAttr{Flags: sftpAttrUIDGID | sftpAttrPermissions, UID: 1000, GID: 100, Mode: sIFREG | 0644},
+		[]byte{0, 0, 0, 6, 0, 0, 3, 0xe8, 0, 0, 0, 100, 0, 0, 0x81, 0xa4},
+	},
+	{
+		"times",
+		sftpAttr{Flags: sftpAttrACModTime, Atime: 1, Mtime: 2},
+		[]byte{0, 0, 0, 8, 0, 0, 0, 1, 0, 0, 0, 2},
+	},
+	{
+		"everything",
+		sftpAttr{
+			Flags: sftpAttrSize | sftpAttrUIDGID | sftpAttrPermissions | sftpAttrACModTime,
+			Size:  3, UID: 4, GID: 5, Mode: sIFDIR | 0755, Atime: 6, Mtime: 7,
+		},
+		[]byte{
+			0, 0, 0, 0x0f,
+			0, 0, 0, 0, 0, 0, 0, 3,
+			0, 0, 0, 4, 0, 0, 0, 5,
+			0, 0, 0x41, 0xed,
+			0, 0, 0, 6, 0, 0, 0, 7,
+		},
+	},
+}
+
+func TestSFTPAttrEncoding(t *testing.T) {
+	for _, v := range sftpAttrVectors {
+		b := &sftpBuilder{}
+		b.attr(&v.attr)
+		if !bytes.Equal(b.buf, v.wire) {
+			t.Errorf("%s: encoded % x, want % x", v.name, b.buf, v.wire)
+		}
+		buf := &sftpBuffer{v.wire}
+		got, err := buf.attr()
+		if err != nil {
+			t.Errorf("%s: decoding: %v", v.name, err)
+			continue
+		}
+		if *got != v.attr || len(buf.data) != 0 {
+			t.Errorf("%s: decoded %+v with %d bytes left, want %+v", v.name, *got, len(buf.data), v.attr)
+		}
+		// Every truncation is a short packet, never a panic.
+		for n := 0; n < len(v.wire); n++ {
+			if _, err := (&sftpBuffer{v.wire[:n]}).attr(); err != ErrSFTPShortPacket {
+				t.Errorf("%s: truncated to %d bytes: got %v, want ErrSFTPShortPacket", v.name, n, err)
+			}
+		}
+	}
+}
+
+func TestSFTPAttrExtendedIgnored(t *testing.T) {
+	b := &sftpBuilder{}
+	b.uint32(sftpAttrPermissions | sftpAttrExtended)
+	b.uint32(0600)
+	b.uint32(1)
+	b.string("name@example.com")
+	b.string("value")
+	b.string("next field")
+	buf := &sftpBuffer{b.buf}
+	attr, err := buf.attr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Mode != 0600 {
+		t.Errorf("mode = %o, want 600", attr.Mode)
+	}
+	if next, err := buf.string(); err != nil || next != "next field" {
+		t.Errorf("after extended attributes: %q, %v", next, err)
+	}
+}
+
+func TestSFTPBufferFields(t *testing.T) {
+	b := &sftpBuilder{}
+	b.uint32(0xdeadbeef)
+	b.uint64(1 << 40)
+	b.string("path/to/file")
+	b.bytes([]byte{0, 1, 2})
+	b.string("")
+	want := []byte{
+		0xde, 0xad, 0xbe, 0xef,
+		0, 0, 1, 0, 0, 0, 0, 0,
+		0, 0, 0, 12, 'p', 'a', 't', 'h', '/', 't', 'o', '/', 'f', 'i', 'l', 'e',
+		0, 0, 0, 3, 0, 1, 2,
+		0, 0, 0, 0,
+	}
+	if !bytes.Equal(b.buf, want) {
+		t.Fatalf("encoded % x, want % x", b.buf, want)
+	}
+	buf := &sftpBuffer{b.buf}
+	if v, err := buf.uint32(); v != 0xdeadbeef || err != nil {
+		t.Errorf("uint32 = %x, %v", v, err)
+	}
+	if v, err := buf.uint64(); v != 1<<40 || err != nil {
+		t.Errorf("uint64 = %x, %v", v, err)
+	}
+	if v, err := buf.string(); v != "path/to/file" || err != nil {
+		t.Errorf("string = %q, %v", v, err)
+	}
+	if v, err := buf.bytes(); !bytes.Equal(v, []byte{0, 1, 2}) || err != nil {
+		t.Errorf("bytes = %v, %v", v, err)
+	}
+	if v, err := buf.string(); v != "" || err != nil {
+		t.Errorf("empty string = %q, %v", v, err)
+	}
+	if _, err := buf.uint32(); err != ErrSFTPShortPacket {
+		t.Errorf("read past the end: %v", err)
+	}
+	// A length running past the packet
+	if _, err := (&sftpBuffer{[]byte{0, 0, 0, 5, 'a'}}).string(); err != ErrSFTPShortPacket {
+		t.Errorf("overlong string: %v", err)
+	}
+}
+
+// An SFTP server on a temporary home directory, driven a packet at a time
+type sftpTest struct {
+	t    *testing.T
+	srv  *sftpServer
+	out  *bytes.Buffer
+	home string
+	id   uint32
+}
+
+func newSFTPTest(t *testing.T) *sftpTest {
+	home := t.TempDir()
+	out := &bytes.Buffer{}
+	st := &sftpTest{
+		t:   t,
+		out: out,
+		srv: &sftpServer{
+			conn:    &ServerConn{Server: NewServer()},
+			out:     bufio.NewWriter(out),
+			home:    home,
+			handles: make(map[string]*sftpOpenFile),
+		},
+		home: home,
+	}
+	t.Cleanup(st.srv.closeAll)
+	return st
+}
+
+// Send one request and return the reply's type and payload after the id
+func (st *sftpTest) request(pktType byte, args func(b *sftpBuilder)) (byte, *sftpBuffer) {
+	st.t.Helper()
+	st.id++
+	b := &sftpBuilder{}
+	args(b)
+	st.out.Reset()
+	if err := st.srv.dispatch(pktType, st.id, &sftpBuffer{b.buf}); err != nil {
+		st.t.Fatal(err)
+	}
+	st.srv.out.Flush()
+	var hdr [5]byte
+	if _, err := io.ReadFull(st.out, hdr[:]); err != nil {
+		st.t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(hdr[:4]); int(n) != st.out.Len()+1 {
+		st.t.Fatalf("reply length %d with %d bytes sent", n, st.out.Len()+1)
+	}
+	reply := &sftpBuffer{st.out.Bytes()}
+	if id, err := reply.uint32(); err != nil || id != st.id {
+		st.t.Fatalf("reply id %d, %v; want %d", id, err, st.id)
+	}
+	return hdr[4], reply
+}
+
+// Send a request that should get a status back, and return the code
+func (st *sftpTest) status(pktType byte, args func(b *sftpBuilder)) uint32 {
+	st.t.Helper()
+	replyType, reply := st.request(pktType, args)
+	if replyType != sftpStatus {
+		st.t.Fatalf("reply type %d, want status", replyType)
+	}
+	code, err := reply.uint32()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return code
+}
+
+func (st *sftpTest) mustStatus(want uint32, pktType byte, args func(b *sftpBuilder)) {
+	st.t.Helper()
+	if code := st.status(pktType, args); code != want {
+		st.t.Fatalf("packet type %d: status %d, want %d", pktType, code, want)
+	}
+}
+
+func (st *sftpTest) handle(pktType byte, args func(b *sftpBuilder)) string {
+	st.t.Helper()
+	replyType, reply := st.request(pktType, args)
+	if replyType != sftpHandle {
+		st.t.Fatalf("packet type %d: reply type %d, want handle", pktType, replyType)
+	}
+	h, err := reply.string()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return h
+}
+
+func (st *sftpTest) open(path string, flags uint32) string {
+	st.t.Helper()
+	return st.handle(sftpOpen, func(b *sftpBuilder) {
+		b.string(path)
+		b.uint32(flags)
+		b.attr(&sftpAttr{})
+	})
+}
+
+func (st *sftpTest) close(h string) {
+	st.t.Helper()
+	st.mustStatus(sftpOK, sftpClose, func(b *sftpBuilder) { b.string(h) })
+}
+
+func (st *sftpTest) stat(path string) *sftpAttr {
+	st.t.Helper()
+	replyType, reply := st.request(sftpStat, func(b *sftpBuilder) { b.string(path) })
+	if replyType != sftpAttrs {
+		st.t.Fatalf("stat %s: reply type %d, want attrs", path, replyType)
+	}
+	attr, err := reply.attr()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return attr
+}
+
+func (st *sftpTest) writeFile(name, data string) {
+	st.t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(st.home, name), []byte(data), 0644); err != nil {
+		st.t.Fatal(err)
+	}
+}
+
+func (st *sftpTest) readFile(name string) string {
+	st.t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(st.home, name))
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSFTPWriteAndRead(t *testing.T) {
+	st := newSFTPTest(t)
+	h := st.open("upload.txt", sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	for _, chunk := range []struct {
+		offset uint64
+		data   string
+	}{{0, "hello "}, {6, "world\n"}} {
+		st.mustStatus(sftpOK, sftpWrite, func(b *sftpBuilder) {
+			b.string(h)
+			b.uint64(chunk.offset)
+			b.string(chunk.data)
+		})
+	}
+	st.close(h)
+	if got := st.readFile("upload.txt"); got != "hello world\n" {
+		t.Fatalf("uploaded %q", got)
+	}
+
+	h = st.open(filepath.Join(st.home, "upload.txt"), sftpFlagRead)
+	replyType, reply := st.request(sftpRead, func(b *sftpBuilder) {
+		b.string(h)
+		b.uint64(6)
+		b.uint32(100)
+	})
+	if data, err := reply.string(); replyType != sftpData || data != "world\n" || err != nil {
+		t.Errorf("read at 6: type %d, %q, %v", replyType, data, err)
+	}
+	st.mustStatus(sftpEOF, sftpRead, func(b *sftpBuilder) {
+		b.string(h)
+		b.uint64(12)
+		b.uint32(100)
+	})
+	st.close(h)
+	st.mustStatus(sftpFailure, sftpClose, func(b *sftpBuilder) { b.string(h) })
+
+	st.mustStatus(sftpNoSuchFile, sftpOpen, func(b *sftpBuilder) {
+		b.string("missing.txt")
+		b.uint32(sftpFlagRead)
+		b.attr(&sftpAttr{})
+	})
+}
+
+func TestSFTPReaddir(t *testing.T) {
+	st := newSFTPTest(t)
+	st.writeFile("a.txt", "a")
+	st.writeFile("b.txt", "bb")
+	if err := os.Mkdir(filepath.Join(st.home, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := st.handle(sftpOpendir, func(b *sftpBuilder) { b.string(".") })
+	sizes := map[string]uint64{}
+	for {
+		replyType, reply := st.request(sftpReaddir, func(b *sftpBuilder) { b.string(h) })
+		if replyType == sftpStatus {
+			if code, _ := reply.uint32(); code != sftpEOF {
+				t.Fatalf("readdir status %d, want EOF", code)
+			}
+			break
+		}
+		count, err := reply.uint32()
+		if replyType != sftpName || err != nil {
+			t.Fatalf("readdir reply type %d, %v", replyType, err)
+		}
+		for i := uint32(0); i < count; i++ {
+			name, _ := reply.string()
+			if _, err := reply.string(); err != nil {
+				t.Fatal(err)
+			}
+			attr, err := reply.attr()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[name] = attr.Size
+			if name == "sub" && attr.Mode&sIFMT != sIFDIR {
+				t.Errorf("sub has mode %o, want a directory", attr.Mode)
+			}
+		}
+	}
+	st.close(h)
+	var names []string
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"a.txt", "b.txt", "sub"}) {
+		t.Errorf("listed %v", names)
+	}
+	if sizes["b.txt"] != 2 {
+		t.Errorf("b.txt has size %d, want 2", sizes["b.txt"])
+	}
+	st.mustStatus(sftpFailure, sftpOpendir, func(b *sftpBuilder) { b.string("a.txt") })
+}
+
+func TestSFTPRename(t *testing.T) {
+	st := newSFTPTest(t)
+	st.writeFile("old.txt", "old")
+	st.writeFile("taken.txt", "taken")
+	rename := func(from, to string) func(b *sftpBuilder) {
+		return func(b *sftpBuilder) {
+			b.string(from)
+			b.string(to)
+		}
+	}
+	// SFTPv3 rename never overwrites.
+	st.mustStatus(sftpFailure, sftpRename, rename("old.txt", "taken.txt"))
+	if got := st.readFile("taken.txt"); got != "taken" {
+		t.Errorf("rename overwrote its target: %q", got)
+	}
+	st.mustStatus(sftpOK, sftpRename, rename("old.txt", "new.txt"))
+	if got := st.readFile("new.txt"); got != "old" {
+		t.Errorf("renamed file holds %q", got)
+	}
+	// posix-rename@openssh.com does.
+	st.mustStatus(sftpOK, sftpExtended, func(b *sftpBuilder) {
+		b.string("posix-rename@openssh.com")
+		b.string("new.txt")
+		b.string("taken.txt")
+	})
+	if got := st.readFile("taken.txt"); got != "old" {
+		t.Errorf("posix-rename left %q", got)
+	}
+	st.mustStatus(sftpNoSuchFile, sftpRename, rename("new.txt", "other.txt"))
+}
+
+func TestSFTPRemove(t *testing.T) {
+	st := newSFTPTest(t)
+	st.writeFile("file.txt", "x")
+	st.mustStatus(sftpOK, sftpMkdir, func(b *sftpBuilder) {
+		b.string("dir")
+		b.attr(&sftpAttr{Flags: sftpAttrPermissions, Mode: 0700})
+	})
+	if fi, err := os.Stat(filepath.Join(st.home, "dir")); err != nil || !fi.IsDir() {
+		t.Fatalf("mkdir: %v", err)
+	}
+	path := func(p string) func(b *sftpBuilder) {
+		return func(b *sftpBuilder) { b.string(p) }
+	}
+	// Each only removes its own kind.
+	st.mustStatus(sftpFailure, sftpRemove, path("dir"))
+	st.mustStatus(sftpFailure, sftpRmdir, path("file.txt"))
+	st.mustStatus(sftpOK, sftpRemove, path("file.txt"))
+	st.mustStatus(sftpOK, sftpRmdir, path("dir"))
+	for _, name := range []string{"file.txt", "dir"} {
+		if _, err := os.Lstat(filepath.Join(st.home, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still there: %v", name, err)
+		}
+	}
+	st.mustStatus(sftpNoSuchFile, sftpRemove, path("file.txt"))
+}
+
+func TestSFTPSetstat(t *testing.T) {
+	st := newSFTPTest(t)
+	st.writeFile("file.txt", "0123456789")
+	fi, err := os.Stat(filepath.Join(st.home, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid, haveOwner := fileOwner(fi)
+	attr := &sftpAttr{
+		Flags: sftpAttrSize | sftpAttrPermissions | sftpAttrACModTime,
+		Size:  4,
+		Mode:  04750,
+		Atime: 1000000000,
+		Mtime: 1200000000,
+	}
+	// Setting the owner too must not clear the setuid bit.
+	if haveOwner {
+		attr.Flags |= sftpAttrUIDGID
+		attr.UID, attr.GID = uid, gid
+	}
+	st.mustStatus(sftpOK, sftpSetstat, func(b *sftpBuilder) {
+		b.string("file.txt")
+		b.attr(attr)
+	})
+	got := st.stat("file.txt")
+	if got.Size != 4 {
+		t.Errorf("size %d, want 4", got.Size)
+	}
+	if got.Mode&07777 != 04750 {
+		t.Errorf("mode %o, want 4750", got.Mode&07777)
+	}
+	if got.Atime != attr.Atime || got.Mtime != attr.Mtime {
+		t.Errorf("times %d/%d, want %d/%d", got.Atime, got.Mtime, attr.Atime, attr.Mtime)
+	}
+
+	// The same through a handle
+	h := st.open("file.txt", sftpFlagWrite)
+	st.mustStatus(sftpOK, sftpFsetstat, func(b *sftpBuilder) {
+		b.string(h)
+		b.attr(&sftpAttr{Flags: sftpAttrSize | sftpAttrPermissions, Size: 1, Mode: 0600})
+	})
+	replyType, reply := st.request(sftpFstat, func(b *sftpBuilder) { b.string(h) })
+	if replyType != sftpAttrs {
+		t.Fatalf("fstat reply type %d", replyType)
+	}
+	if got, err := reply.attr(); err != nil || got.Size != 1 || got.Mode&07777 != 0600 {
+		t.Errorf("after fsetstat: %+v, %v", got, err)
+	}
+	st.close(h)
+}
@@ -18,7 +18,8 @@ func handleSpawnHelper() {
 	if err != nil {
 		dbg.Fatalf("invalid ctty: %v", ctty)
 	}
-	spawnArgs := os.Args[3:]
+	spawnPath := os.Args[3]
+	spawnArgs := os.Args[4:]
 
 	dbg.Debug("checking tty fd...")
 	tty := os.NewFile(uintptr(ctty), "tty")
@@ -43,7 +44,8 @@ func handleSpawnHelper() {
 	}
 
 	dbg.Debug("spawning original program")
-	cmd := exec.Command(spawnArgs[0], spawnArgs[1:]...)
+	cmd := exec.Command(spawnPath)
+	cmd.Args = spawnArgs
 	cmd.Env = syscall.Environ()
 	cmd.Dir, _ = os.Getwd()
 	//f, _ := os.OpenFile("/tmp/sshdogspawn", os.O_RDWR|os.O_CREATE, 0777)
@@ -22,8 +22,10 @@ import (
 	"github.com/Matir/sshdog/dbglog"
 	"io"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -33,7 +35,7 @@ var dbg = dbglog.Dbg
 func getPort(box *rice.Box) int16 {
 	if len(os.Args) > 1 {
 		if port, err := strconv.Atoi(os.Args[1]); err != nil {
-			dbg.Debug("Error parsing %s as port: %v", os.Args[1], err)
+			dbg.Warn("Error parsing %s as port: %v", os.Args[1], err)
 		} else {
 			return int16(port)
 		}
@@ -41,7 +43,7 @@ func getPort(box *rice.Box) int16 {
 	if portData, err := box.String("port"); err == nil {
 		portData = strings.TrimSpace(portData)
 		if port, err := strconv.Atoi(portData); err != nil {
-			dbg.Debug("Error parsing %s as port: %v", portData, err)
+			dbg.Warn("Error parsing %s as port: %v", portData, err)
 		} else {
 			return int16(port)
 		}
@@ -49,6 +51,60 @@ func getPort(box *rice.Box) int16 {
 	return 2222 // default
 }
 
+// Read an integer setting, or return def
+func getInt(box *rice.Box, name string, def int) int {
+	if data, err := box.String(name); err == nil {
+		data = strings.TrimSpace(data)
+		if val, err := strconv.Atoi(data); err != nil {
+			dbg.Warn("Error parsing %s as %s: %v", data, name, err)
+		} else {
+			return val
+		}
+	}
+	return def
+}
+
+// Read a duration setting such as "10m", or return def
+func getDuration(box *rice.Box, name string, def time.Duration) time.Duration {
+	if data, err := box.String(name); err == nil {
+		data = strings.TrimSpace(data)
+		if val, err := time.ParseDuration(data); err != nil {
+			dbg.Warn("Error parsing %s as %s: %v", data, name, err)
+		} else {
+			return val
+		}
+	}
+	return def
+}
+
+// Read a size setting such as "10M" (K, M and G are powers of 1024), or
+// return def
+func getSize(box *rice.Box, name string, def int64) int64 {
+	if data, err := box.String(name); err == nil {
+		data = strings.ToUpper(strings.TrimSpace(data))
+		mult := int64(1)
+		if n := len(data); n > 0 {
+			switch data[n-1] {
+			case 'K':
+				mult = 1 << 10
+			case 'M':
+				mult = 1 << 20
+			case 'G':
+				mult = 1 << 30
+			}
+			if mult > 1 {
+				data = data[:n-1]
+			}
+		}
+		if val, err := strconv.ParseInt(data, 10, 64); err != nil {
+			dbg.Warn("Error parsing %s as %s: %v", data, name, err)
+		} else {
+			return val * mult
+		}
+	}
+	return def
+}
+
 // Just check if a file exists
 func fileExists(box *rice.Box, name string) bool {
 	_, err := box.Bytes(name)
@@ -65,6 +121,60 @@ func beQuiet(box *rice.Box) bool {
 	return fileExists(box, "quiet")
 }
 
+// Set up logging from log_level, log_format and log_output.  quiet turns
+// off all output, errors included.  Log files, the daemon's by default, are
+// rotated as log_max_size, log_max_age, log_max_backups and log_compress say.
+func configureLogging(box *rice.Box, isDaemonWorker bool) {
+	if beQuiet(box) {
+		dbg.Enable = false
+	}
+	if levels, err := box.String("log_level"); err == nil {
+		if err := dbglog.SetLevels(levels); err != nil {
+			dbg.Warn("Error parsing log_level: %v", err)
+		}
+	}
+	if name, err := box.String("log_format"); err == nil {
+		if format, err := dbglog.ParseFormat(name); err != nil {
+			dbg.Warn("Error parsing log_format: %v", err)
+		} else {
+			dbglog.SetFormat(format)
+		}
+	}
+	out := "stderr"
+	if isDaemonWorker {
+		out = daemon.LogPath
+	}
+	if data, err := box.String("log_output"); err == nil {
+		out = strings.TrimSpace(data)
+	}
+	switch out {
+	case "", "stderr":
+	case "syslog":
+		if err := dbglog.OpenSyslog("sshdog"); err != nil {
+			dbg.Warn("Error opening syslog: %v", err)
+		}
+	default:
+		daemon.LogPath = out
+		rot := dbglog.Rotation{
+			MaxSize:    getSize(box, "log_max_size", 0),
+			MaxAge:     getDuration(box, "log_max_age", 0),
+			MaxBackups: getInt(box, "log_max_backups", 0),
+			Compress:   fileExists(box, "log_compress"),
+		}
+		if err := dbglog.OpenRotatingFile(out, rot); err != nil {
+			dbg.Warn("Error opening log file %s: %v", out, err)
+			return
+		}
+		if isDaemonWorker {
+			// Our stdio is /dev/null; catch panics in the log.
+			if err := dbglog.CaptureStderr(); err != nil {
+				dbg.Warn("Error redirecting stderr to %s: %v", out, err)
+			}
+		}
+		go reopenLogOnSignal()
+	}
+}
+
 var mainBox *rice.Box
 
 func readExitInput() {
@@ -83,7 +193,7 @@ func readExitInput() {
 				} // else the user may input an EOF after some time
 			}
 			if err != io.EOF {
-				dbg.Debug("fatal: unknown read err: %v", err)
+				dbg.Error("fatal: unknown read err: %v", err)
 				os.Exit(1)
 			} else {
 				os.Exit(0)
@@ -113,6 +223,9 @@ func main() {
 			fmt.Printf("Fuck!")
 			os.Exit(1)
 		}
+		if os.Args[1] == fileHelperArg {
+			os.Exit(handleFileHelper(os.Args[2:]))
+		}
 		if os.Args[1] == "daemon" {
 			isDaemonWorker = true
 		}
@@ -120,13 +233,11 @@ func main() {
 
 	mainBox = mustFindBox()
 
-	if beQuiet(mainBox) {
-		dbg.Enable = false
-	}
+	configureLogging(mainBox, isDaemonWorker)
 
 	if !isDaemonWorker && shouldDaemonize(mainBox) {
 		if err := daemon.Daemonize(daemonStart); err != nil {
-			dbg.Debug("Error daemonizing: %v", err)
+			dbg.Error("Error daemonizing: %v", err)
 		}
 	} else {
 		//err := syscall.Setpgid(0, 0)
@@ -158,6 +269,28 @@ func mustFindBox() *rice.Box {
 	}
 }
 
+// Shut down cleanly, hanging up on running sessions, on SIGINT or SIGTERM
+func stopOnSignal(server *Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	dbg.Info("Received %v, shutting down.", sig)
+	server.Stop()
+}
+
+// Reopen the log file on SIGHUP, for external log rotation
+func reopenLogOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if err := dbglog.Reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reopening log file: %v\n", err)
+			continue
+		}
+		dbg.Info("Reopened log file.")
+	}
+}
+
 // Actually run the implementation of the daemon
 func daemonStart() (waitFunc func(), stopFunc func()) {
 	server := NewServer()
@@ -167,32 +300,104 @@ func daemonStart() (waitFunc func(), stopFunc func()) {
 		if keyData, err := mainBox.Bytes(keyName); err == nil {
 			dbg.Debug("Adding hostkey file: %s", keyName)
 			if err = server.AddHostkey(keyData); err != nil {
-				dbg.Debug("Error adding public key: %v", err)
+				dbg.Warn("Error adding public key: %v", err)
 			}
 			hasHostKeys = true
+			if certData, err := mainBox.Bytes(keyName + "-cert.pub"); err == nil {
+				dbg.Debug("Adding host certificate file: %s-cert.pub", keyName)
+				if err = server.AddHostCertificate(certData); err != nil {
+					dbg.Warn("Error adding host certificate: %v", err)
+				}
+			}
 		}
 	}
 	if !hasHostKeys {
-		if err := server.RandomHostkey(); err != nil {
-			dbg.Debug("Error adding random hostkey: %v", err)
+		if stateDir, err := mainBox.String("state_dir"); err == nil {
+			if err := server.PersistentHostkeys(strings.TrimSpace(stateDir)); err != nil {
+				dbg.Warn("Error loading or saving hostkeys: %v", err)
+				return
+			}
+		} else if err := server.RandomHostkey(); err != nil {
+			dbg.Error("Error adding random hostkey: %v", err)
 			return
 		}
 	}
-	authSet := false
 	if passwordData, err := mainBox.Bytes("password"); err == nil {
 		dbg.Debug("Setting auth password.")
 		server.SetAuthPassword(passwordData)
-		authSet = true
 	}
 	if authData, err := mainBox.Bytes("authorized_keys"); err == nil {
 		dbg.Debug("Adding authorized_keys.")
 		server.AddAuthorizedKeys(authData)
-		authSet = true
 	}
-	if !authSet {
-		dbg.Debug("Neither password nor key was configured. We will not do any auth!")
+	if userData, err := mainBox.Bytes("users"); err == nil {
+		dbg.Debug("Adding users.")
+		if err := server.AddUsers(userData); err != nil {
+			dbg.Warn("Error parsing users: %v", err)
+		}
+	}
+	if caData, err := mainBox.Bytes("trusted_user_ca_keys"); err == nil {
+		dbg.Debug("Adding trusted_user_ca_keys.")
+		server.AddTrustedUserCAKeys(caData)
+	}
+	if serialData, err := mainBox.Bytes("revoked_cert_serials"); err == nil {
+		dbg.Debug("Adding revoked_cert_serials.")
+		server.AddRevokedSerials(serialData)
+	}
+	// Cleared only once a password, key or CA has actually been installed
+	if server.ServerConfig.NoClientAuth {
+		dbg.Warn("Neither password nor key was configured. We will not do any auth!")
 		//return
 	}
+	if envData, err := mainBox.Bytes("base_environment"); err == nil {
+		dbg.Debug("Setting base_environment.")
+		server.SetBaseEnv(envData)
+	}
+	if acceptData, err := mainBox.Bytes("accept_env"); err == nil {
+		dbg.Debug("Setting accept_env.")
+		server.SetAcceptEnv(acceptData)
+	}
+	if denyData, err := mainBox.Bytes("deny_env"); err == nil {
+		dbg.Debug("Setting deny_env.")
+		server.SetDenyEnv(denyData)
+	}
+	server.SetMaxAuthTries(getInt(mainBox, "max_auth_tries", 6))
+	server.SetBanPolicy(
+		getInt(mainBox, "auth_ban_threshold", defaultBanThreshold),
+		getDuration(mainBox, "auth_ban_window", defaultBanWindow),
+		getDuration(mainBox, "auth_ban_duration", defaultBanDuration))
+	if bannerData, err := mainBox.Bytes("banner"); err == nil {
+		dbg.Debug("Setting banner.")
+		server.SetBanner(bannerData)
+	}
+	if motdData, err := mainBox.Bytes("motd"); err == nil {
+		dbg.Debug("Setting motd.")
+		if err := server.SetMotd(motdData); err != nil {
+			dbg.Warn("Error parsing motd: %v", err)
+		}
+	}
+	if fileExists(mainBox, "no_agent_forwarding") {
+		dbg.Debug("Disabling agent forwarding.")
+		server.NoAgentForwarding = true
+	}
+	if fileExists(mainBox, "no_x11_forwarding") {
+		dbg.Debug("Disabling X11 forwarding.")
+		server.NoX11Forwarding = true
+	}
+	if recordDir, err := mainBox.String("record_dir"); err == nil {
+		server.RecordDir = strings.TrimSpace(recordDir)
+		server.RecordInput = fileExists(mainBox, "record_input")
+		dbg.Debug("Recording pty sessions to %s.", server.RecordDir)
+	}
+	if auditPath, err := mainBox.String("audit_log"); err == nil {
+		auditPath = strings.TrimSpace(auditPath)
+		dbg.Debug("Writing audit log to %s.", auditPath)
+		if err := server.SetAuditLog(auditPath); err != nil {
+			dbg.Warn("Error opening audit log: %v", err)
+		}
+	}
+	server.SetHangupGrace(getDuration(mainBox, "hangup_grace", defaultHangupGrace))
 	server.ListenAndServe(getPort(mainBox))
+	go stopOnSignal(server)
 	return server.Wait, server.Stop
 }
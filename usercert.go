@@ -0,0 +1,171 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// OpenSSH user certificates signed by a trusted CA.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strconv"
+	"time"
+)
+
+const sourceAddressOption = "source-address"
+
+// Add CA keys whose user certificates we accept, in authorized_keys format.
+// Options on a line restrict that CA's certificates as they would in
+// authorized_keys.
+func (s *Server) AddTrustedUserCAKeys(keyData []byte) {
+	for len(keyData) > 0 {
+		caKey, _, options, left, err := ssh.ParseAuthorizedKey(keyData)
+		keyData = left
+		if err != nil {
+			dbg.Debug("Error parsing CA key: %v", err)
+			break
+		}
+		opts, err := parseKeyOptions(options)
+		if err != nil {
+			dbg.Debug("Skipping CA key with bad options: %v", err)
+			continue
+		}
+		s.addUserCAKey(string(caKey.Marshal()), opts)
+	}
+}
+
+func (s *Server) addUserCAKey(keyStr string, opts *keyOptions) {
+	s.UserCAKeys[keyStr] = opts
+	s.ServerConfig.PublicKeyCallback = s.VerifyPublicKey
+	s.ServerConfig.NoClientAuth = false
+}
+
+// Add revoked certificate serial numbers, one per line
+func (s *Server) AddRevokedSerials(serialData []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(serialData))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		serial, err := strconv.ParseUint(string(line), 0, 64)
+		if err != nil {
+			dbg.Debug("Error parsing revoked serial %q: %v", line, err)
+			continue
+		}
+		s.RevokedSerials[serial] = true
+	}
+}
+
+// Check a user certificate against the trusted CAs
+func (s *Server) verifyCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate, account *userAccount) (*ssh.Permissions, error) {
+	if len(cert.ValidPrincipals) == 0 {
+		// Go would accept this for any user; OpenSSH would not.
+		return nil, fmt.Errorf("certificate has no principals")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+	caKey := string(cert.SignatureKey.Marshal())
+	var caOpts *keyOptions
+	if account != nil {
+		caOpts = account.CAKeys[caKey]
+	}
+	if caOpts == nil {
+		caOpts = s.UserCAKeys[caKey]
+		if caOpts == nil {
+			return nil, fmt.Errorf("certificate signed by unrecognized authority")
+		}
+		// Like our plain keys, principals= on our own CA lines only
+		// stands in for logins that aren't configured users.
+		if account != nil && len(caOpts.Principals) > 0 {
+			return nil, fmt.Errorf("principals= authority does not cover user %s", account.Name)
+		}
+	}
+	// With principals=, the certificate must name one of them rather than
+	// the login user.
+	principal := conn.User()
+	if len(caOpts.Principals) > 0 {
+		principal = matchPrincipal(caOpts.Principals, cert.ValidPrincipals)
+		if principal == "" {
+			return nil, fmt.Errorf("certificate principals not permitted by principals=")
+		}
+	}
+	checker := &ssh.CertChecker{
+		SupportedCriticalOptions: []string{permForceCommand, sourceAddressOption},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return s.RevokedSerials[cert.Serial]
+		},
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return nil, err
+	}
+	if err := caOpts.checkLogin(conn.RemoteAddr(), time.Now()); err != nil {
+		return nil, err
+	}
+	certPerms := &cert.Permissions
+	dbg.Debug("Accepted certificate %q serial %d", cert.KeyId, cert.Serial)
+
+	opts, err := certKeyOptions(certPerms, caOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	perms := opts.permissions()
+	// The ssh package enforces source-address for us after we return.
+	if sourceAddr, ok := certPerms.CriticalOptions[sourceAddressOption]; ok {
+		perms.CriticalOptions[sourceAddressOption] = sourceAddr
+	}
+	return perms, nil
+}
+
+// First certificate principal listed in a principals= option
+func matchPrincipal(allowed, principals []string) string {
+	for _, p := range principals {
+		for _, a := range allowed {
+			if p == a {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// Combine what a certificate permits with the restrictions on its CA key,
+// the stricter of the two winning.
+func certKeyOptions(certPerms *ssh.Permissions, caOpts *keyOptions) (*keyOptions, error) {
+	command := certPerms.CriticalOptions[permForceCommand]
+	if caOpts.Command != "" {
+		if command != "" && command != caOpts.Command {
+			return nil, fmt.Errorf("certificate and cert-authority force different commands")
+		}
+		command = caOpts.Command
+	}
+	_, permitPty := certPerms.Extensions["permit-pty"]
+	_, permitPortForwarding := certPerms.Extensions["permit-port-forwarding"]
+	_, permitAgentForwarding := certPerms.Extensions["permit-agent-forwarding"]
+	_, permitX11Forwarding := certPerms.Extensions["permit-X11-forwarding"]
+	return &keyOptions{
+		Command:           command,
+		NoPty:             !permitPty || caOpts.NoPty,
+		NoPortForwarding:  !permitPortForwarding || caOpts.NoPortForwarding,
+		NoAgentForwarding: !permitAgentForwarding || caOpts.NoAgentForwarding,
+		NoX11Forwarding:   !permitX11Forwarding || caOpts.NoX11Forwarding,
+		PermitOpen:        caOpts.PermitOpen,
+		PermitListen:      caOpts.PermitListen,
+		Environment:       caOpts.Environment,
+		Record:            caOpts.Record,
+	}, nil
+}
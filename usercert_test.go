@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Just enough of a connection for the auth callbacks
+type testConnMetadata struct {
+	user string
+}
+
+func (c testConnMetadata) User() string          { return c.user }
+func (c testConnMetadata) SessionID() []byte     { return nil }
+func (c testConnMetadata) ClientVersion() []byte { return nil }
+func (c testConnMetadata) ServerVersion() []byte { return nil }
+func (c testConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+}
+func (c testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// A user certificate for principals, signed by ca
+func newTestCert(t *testing.T, ca ssh.Signer, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPrincipalsAuthorityScope(t *testing.T) {
+	ca := newTestSigner(t)
+	caLine := `cert-authority,principals="ops" ` + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	users, err := json.Marshal(map[string]userConfig{
+		"alice": {AuthorizedKeys: caLine},
+		"bob":   {Password: sha512CryptVectors[0].hash},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.AddAuthorizedKeys([]byte(caLine))
+	if err := server.AddUsers(users); err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCert(t, ca, "ops")
+
+	for _, tc := range []struct {
+		user string
+		ok   bool
+	}{
+		{"anyone", true}, // not a configured user: the global line covers it
+		{"alice", true},  // her own line
+		{"bob", false},   // configured, with no such line
+	} {
+		perms, err := server.verifyPublicKey(testConnMetadata{tc.user}, cert)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("login as %s: err = %v, want ok = %v", tc.user, err, tc.ok)
+			continue
+		}
+		if tc.ok && tc.user == "alice" && perms.Extensions[permUser] != "alice" {
+			t.Errorf("login as alice: permissions %v don't name her", perms.Extensions)
+		}
+	}
+
+	// Without principals=, the certificate must name the login user.
+	plain := NewServer()
+	plain.AddTrustedUserCAKeys(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	if _, err := plain.verifyPublicKey(testConnMetadata{"anyone"}, cert); err == nil {
+		t.Error("certificate for ops accepted for anyone")
+	}
+	if _, err := plain.verifyPublicKey(testConnMetadata{"ops"}, cert); err != nil {
+		t.Errorf("certificate for ops refused for ops: %v", err)
+	}
+}
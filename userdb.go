@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Lookups in the system user database.
+package main
+
+import (
+	exec2 "github.com/Matir/sshdog/exec"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// The system account a login runs as: the one with the login's name if
+// we are it, or if we are root and can start its commands under its own
+// uid (see setCredential); otherwise our own.  Running another user's
+// shell and profile scripts with our privileges would let anyone who can
+// edit them run code as us.
+func systemAccount(name string) *user.User {
+	if account, err := user.Lookup(name); err == nil {
+		uid := os.Getuid()
+		if strconv.Itoa(uid) == account.Uid || (uid == 0 && exec2.SupportsCredential) {
+			return account
+		}
+	}
+	if account, err := user.Current(); err == nil {
+		return account
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Login shell of the named user from /etc/passwd, or "" if unknown.
+// os/user doesn't expose it.
+func passwdShell(name string) string {
+	data, err := ioutil.ReadFile("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == name {
+			return strings.TrimSpace(fields[6])
+		}
+	}
+	return ""
+}
+
+// Do sessions of this account run under a uid other than ours?
+func switchesUser(account *user.User) bool {
+	return account != nil && account.Uid != strconv.Itoa(os.Getuid())
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Named user accounts, configured from the "users" file:
+//
+//	{
+//	  "alice": {
+//	    "password": "$6$...",
+//	    "authorized_keys": "ssh-ed25519 AAAA... alice@laptop",
+//	    "shell": "/bin/bash",
+//	    "home": "/home/alice",
+//	    "env": ["EDITOR=vim"],
+//	    "record": true
+//	  }
+//	}
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/ssh"
+)
+
+// Extension carrying the account name through ssh.Permissions
+const permUser = "user"
+
+// A configured user account
+type userAccount struct {
+	Name           string
+	PasswordHash   string
+	AuthorizedKeys map[string]*keyOptions
+	CAKeys         map[string]*keyOptions // cert-authority lines
+	Shell          string
+	Home           string
+	Env            []string
+	Record         *bool // nil leaves it to the server
+}
+
+// On-disk form of a user account
+type userConfig struct {
+	Password       string   `json:"password"`
+	AuthorizedKeys string   `json:"authorized_keys"`
+	Shell          string   `json:"shell"`
+	Home           string   `json:"home"`
+	Env            []string `json:"env"`
+	Record         *bool    `json:"record"`
+}
+
+// Load user accounts from the JSON users file
+func (s *Server) AddUsers(userData []byte) error {
+	var config map[string]userConfig
+	if err := json.Unmarshal(userData, &config); err != nil {
+		return err
+	}
+	for name, uc := range config {
+		account := &userAccount{
+			Name:         name,
+			PasswordHash: uc.Password,
+			Shell:        uc.Shell,
+			Home:         uc.Home,
+			Env:          uc.Env,
+			Record:       uc.Record,
+		}
+		account.AuthorizedKeys, account.CAKeys = parseAuthorizedKeys([]byte(uc.AuthorizedKeys))
+		if account.PasswordHash != "" {
+			s.ServerConfig.PasswordCallback = s.VerifyPassword
+			s.ServerConfig.NoClientAuth = false
+		}
+		if len(account.AuthorizedKeys) > 0 || len(account.CAKeys) > 0 {
+			s.ServerConfig.PublicKeyCallback = s.VerifyPublicKey
+			s.ServerConfig.NoClientAuth = false
+		}
+		if account.PasswordHash == "" && len(account.AuthorizedKeys) == 0 && len(account.CAKeys) == 0 {
+			dbg.Warn("User %s has neither a password nor keys.", name)
+		}
+		dbg.Debug("Adding user %s.", name)
+		s.Users[name] = account
+	}
+	return nil
+}
+
+// Check a password for a configured user
+func (account *userAccount) checkPassword(password []byte) bool {
+	if account.PasswordHash == "" {
+		// Burn the same time as a real check.
+		checkPasswordHash(dummyPasswordHash, password)
+		return false
+	}
+	ok, err := checkPasswordHash(account.PasswordHash, password)
+	if err != nil {
+		dbg.Debug("Error checking password for %s: %v", account.Name, err)
+	}
+	return ok
+}
+
+// Record the authenticated account in the permissions
+func (account *userAccount) addToPermissions(perms *ssh.Permissions) *ssh.Permissions {
+	if perms == nil {
+		perms = &ssh.Permissions{}
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = make(map[string]string)
+	}
+	perms.Extensions[permUser] = account.Name
+	return perms
+}
+
+// Find the account an authenticated connection logged in as, if any
+func (s *Server) userFromPermissions(perms *ssh.Permissions) *userAccount {
+	if perms == nil {
+		return nil
+	}
+	if name, ok := perms.Extensions[permUser]; ok {
+		return s.Users[name]
+	}
+	return nil
+}
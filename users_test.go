@@ -0,0 +1,36 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestAddUsersNeedsCredentials(t *testing.T) {
+	server := NewServer()
+	if err := server.AddUsers([]byte(`{"alice": {"shell": "/bin/sh"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !server.ServerConfig.NoClientAuth {
+		t.Error("user without password or keys turned on client auth")
+	}
+	users := `{"bob": {"password": "` + sha512CryptVectors[0].hash + `"}}`
+	if err := server.AddUsers([]byte(users)); err != nil {
+		t.Fatal(err)
+	}
+	if server.ServerConfig.NoClientAuth {
+		t.Error("user with a password left client auth off")
+	}
+}
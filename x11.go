@@ -0,0 +1,169 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// X11 forwarding (ssh -X): a local display whose connections are passed
+// back to the client's X server, with the client's cookie written to a
+// private Xauthority file.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// First display number tried, leaving room for real X servers
+	x11DisplayOffset = 10
+	x11MaxDisplays   = 1000
+	x11BasePort      = 6000
+	// Xauthority family matching any address
+	xauthFamilyWild = 0xffff
+)
+
+// Payload of x11-req
+type x11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// Payload of x11 channels
+type x11ChannelMessage struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+// A forwarded display belonging to one session
+type x11Forward struct {
+	listener net.Listener
+	display  string
+	dir      string // holds the Xauthority file
+}
+
+// May this connection forward X11?
+func (conn *ServerConn) permitsX11Forwarding() bool {
+	return !conn.NoX11Forwarding && !conn.opts.NoX11Forwarding
+}
+
+// Listen on the first free display on the loopback interface
+func listenX11Display() (net.Listener, int, error) {
+	var lastErr error
+	for n := x11DisplayOffset; n < x11DisplayOffset+x11MaxDisplays; n++ {
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(x11BasePort+n)))
+		if err == nil {
+			return l, n, nil
+		}
+		lastErr = err
+	}
+	return nil, 0, fmt.Errorf("no free X11 display: %v", lastErr)
+}
+
+// Append a counted string to an Xauthority entry
+func writeXauthField(buf *bytes.Buffer, field []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(field)))
+	buf.Write(field)
+}
+
+// Write an Xauthority file with the cookie for display number n
+func writeXauthority(path string, n int, proto string, cookie []byte) error {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint16(xauthFamilyWild))
+	writeXauthField(buf, nil)
+	writeXauthField(buf, []byte(strconv.Itoa(n)))
+	writeXauthField(buf, []byte(proto))
+	writeXauthField(buf, cookie)
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// Handle x11-req: set up a display for the session's command
+func (conn *ServerConn) startX11Forwarding(sess *session, req *x11Request) error {
+	if sess.x11 != nil {
+		return fmt.Errorf("X11 forwarding already set up")
+	}
+	cookie, err := hex.DecodeString(req.AuthCookie)
+	if err != nil {
+		return fmt.Errorf("bad X11 cookie: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "sshdog-x11")
+	if err != nil {
+		return err
+	}
+	l, n, err := listenX11Display()
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := writeXauthority(filepath.Join(dir, "Xauthority"), n, req.AuthProtocol, cookie); err != nil {
+		l.Close()
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := chownToAccount(conn.account, dir, filepath.Join(dir, "Xauthority")); err != nil {
+		l.Close()
+		os.RemoveAll(dir)
+		return err
+	}
+	fwd := &x11Forward{
+		listener: l,
+		display:  fmt.Sprintf("localhost:%d.%d", n, req.ScreenNumber),
+		dir:      dir,
+	}
+	dbg.Debug("X11 forwarding on display %s", fwd.display)
+	sess.x11 = fwd
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				dbg.Debug("X11 listener done: %v", err)
+				return
+			}
+			if req.SingleConnection {
+				l.Close()
+			}
+			go func() {
+				defer c.Close()
+				addr, portStr, _ := net.SplitHostPort(c.RemoteAddr().String())
+				port, _ := strconv.Atoi(portStr)
+				payload := ssh.Marshal(&x11ChannelMessage{addr, uint32(port)})
+				conn.forwardToClient("x11", payload, c)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Variables telling X clients where to connect
+func (fwd *x11Forward) environ() []string {
+	return []string{
+		"DISPLAY=" + fwd.display,
+		"XAUTHORITY=" + filepath.Join(fwd.dir, "Xauthority"),
+	}
+}
+
+// Stop listening and remove the Xauthority file
+func (fwd *x11Forward) close() {
+	fwd.listener.Close()
+	if err := os.RemoveAll(fwd.dir); err != nil {
+		dbg.Debug("Unable to remove %s: %v", fwd.dir, err)
+	}
+}
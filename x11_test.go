@@ -0,0 +1,191 @@
+// Copyright 2016 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Start a server on loopback and log in to it with a fresh key
+func dialTestServer(t *testing.T) *ssh.Client {
+	server := NewServer()
+	if err := server.RandomHostkey(); err != nil {
+		t.Fatal(err)
+	}
+	key := newTestSigner(t)
+	server.AddAuthorizedKeys(ssh.MarshalAuthorizedKey(key.PublicKey()))
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Socket = sock
+	go server.serveLoop()
+	t.Cleanup(func() {
+		server.Stop()
+		server.Wait()
+	})
+	client, err := ssh.Dial("tcp", sock.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestX11Forwarding(t *testing.T) {
+	client := dialTestServer(t)
+	// The stand-in X server, on the client's side: answers "hello" with
+	// "world".
+	x11Chans := client.HandleChannelOpen("x11")
+	served := make(chan error, 1)
+	go func() {
+		nc, ok := <-x11Chans
+		if !ok {
+			served <- io.EOF
+			return
+		}
+		var msg x11ChannelMessage
+		if err := ssh.Unmarshal(nc.ExtraData(), &msg); err != nil || msg.OriginatorAddress != "127.0.0.1" {
+			nc.Reject(ssh.ConnectionFailed, "bad x11 channel")
+			served <- err
+			return
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		defer ch.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(ch, buf); err != nil {
+			served <- err
+			return
+		}
+		if string(buf) != "hello" {
+			served <- io.ErrUnexpectedEOF
+			return
+		}
+		_, err = ch.Write([]byte("world"))
+		served <- err
+	}()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	cookie := []byte("0123456789abcdef")
+	ok, err := sess.SendRequest("x11-req", true, ssh.Marshal(&x11Request{
+		SingleConnection: true,
+		AuthProtocol:     "MIT-MAGIC-COOKIE-1",
+		AuthCookie:       hex.EncodeToString(cookie),
+	}))
+	if err != nil || !ok {
+		t.Fatalf("x11-req refused: %v", err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start(`sh -c 'echo "$DISPLAY $XAUTHORITY"; read line'`); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "localhost:") {
+		t.Fatalf("command saw DISPLAY and XAUTHORITY %q", line)
+	}
+	display := strings.TrimSuffix(strings.TrimPrefix(fields[0], "localhost:"), ".0")
+	xauthority := fields[1]
+
+	// The cookie, for any address, on this display
+	want := &bytes.Buffer{}
+	want.Write([]byte{0xff, 0xff, 0, 0})
+	writeXauthField(want, []byte(display))
+	writeXauthField(want, []byte("MIT-MAGIC-COOKIE-1"))
+	writeXauthField(want, cookie)
+	if got, err := ioutil.ReadFile(xauthority); err != nil || !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("Xauthority = %x, %v; want %x", got, err, want.Bytes())
+	}
+
+	// The stand-in X client
+	n, err := strconv.Atoi(display)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(x11BasePort+n))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil || string(reply) != "world" {
+		t.Errorf("X client read %q, %v; want world", reply, err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("X server: %v", err)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("second connection accepted in single-connection mode")
+	}
+
+	// Ending the command ends the session, which removes the Xauthority.
+	stdin.Close()
+	sess.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(xauthority); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Xauthority left behind after the session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Dir(xauthority)); !os.IsNotExist(err) {
+		t.Errorf("X11 directory left behind: %v", err)
+	}
+}